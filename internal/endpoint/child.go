@@ -0,0 +1,121 @@
+package endpoint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Waiter is an endpoint with a process or terminal behind it, which is waited for once I/O stops and reported
+// on in the summary.
+type Waiter interface {
+	Wait()
+	Report(out io.Writer)
+}
+
+// child is an exec:// endpoint: a command run without a shell, its arguments split on spaces. Reading drains
+// its stdout and writing feeds its stdin; whichever side is not used is left as /dev/null or this process's
+// stdout. Its stderr goes to this process's stderr.
+type child struct {
+	name    string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  io.ReadCloser
+	started time.Time
+	exited  time.Time
+	waited  sync.Once
+	state   *os.ProcessState
+}
+
+func startChild(name string, flag int) (*child, error) {
+	args := strings.Fields(strings.TrimPrefix(name, "exec://"))
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command in '%s'", name)
+	}
+	c := &child{name: name, cmd: exec.Command(args[0], args[1:]...)}
+	c.cmd.Stderr = os.Stderr
+	var err error
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if c.stdin, err = c.cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if flag&os.O_WRONLY == 0 {
+		if c.stdout, err = c.cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+	} else {
+		c.cmd.Stdout = os.Stdout
+	}
+	if err = c.cmd.Start(); err != nil {
+		return nil, err
+	}
+	c.started = time.Now()
+	AtExit(func() {
+		if c.state == nil {
+			c.cmd.Process.Kill()
+		}
+	})
+	return c, nil
+}
+
+func (c *child) Read(p []byte) (int, error) {
+	if c.stdout == nil {
+		return 0, io.EOF
+	}
+	return c.stdout.Read(p)
+}
+
+func (c *child) Write(p []byte) (int, error) {
+	if c.stdin == nil {
+		return 0, fmt.Errorf("%s was not started for writing", c.name)
+	}
+	return c.stdin.Write(p)
+}
+
+// CloseWrite closes the child's stdin so it sees EOF.
+func (c *child) CloseWrite() error {
+	if c.stdin == nil {
+		return nil
+	}
+	return c.stdin.Close()
+}
+
+// Wait closes the child's stdin and stdout, so it sees EOF or SIGPIPE if it is still running, and waits for it
+// to exit. Only the first call does so; any other, even from another goroutine, returns once that one has.
+func (c *child) Wait() {
+	c.waited.Do(func() {
+		c.CloseWrite()
+		if c.stdout != nil {
+			c.stdout.Close()
+		}
+		c.cmd.Wait()
+		c.exited = time.Now()
+		c.state = c.cmd.ProcessState
+	})
+}
+
+func (c *child) Close() error {
+	c.Wait()
+	return nil
+}
+
+// Report prints how the child exited and how long and how much CPU time it ran for.
+func (c *child) Report(out io.Writer) {
+	if c.state == nil {
+		fmt.Fprintf(out, "Child %s (pid %d) has not been waited for\n", c.name, c.cmd.Process.Pid)
+		return
+	}
+	ws, _ := c.state.Sys().(syscall.WaitStatus)
+	how := fmt.Sprintf("exited with status %d", ws.ExitStatus())
+	if ws.Signaled() {
+		how = fmt.Sprintf("was killed by %v", ws.Signal())
+	}
+	fmt.Fprintf(out, "Child %s (pid %d) %s after %s, user %s, system %s\n", c.name, c.state.Pid(), how,
+		c.exited.Sub(c.started).String(), c.state.UserTime().String(), c.state.SystemTime().String())
+}
@@ -0,0 +1,44 @@
+package endpoint
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestChildWaitConcurrent(t *testing.T) {
+	c, err := startChild("exec://sleep 0.1", os.O_WRONLY)
+	if err != nil {
+		t.Skip(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Wait()
+		}()
+	}
+	c.Close()
+	wg.Wait()
+	var out bytes.Buffer
+	c.Report(&out)
+	if !strings.Contains(out.String(), "exited with status 0") {
+		t.Errorf("report %q", out.String())
+	}
+}
+
+func TestChildReportBeforeWait(t *testing.T) {
+	c, err := startChild("exec://sleep 0.1", os.O_WRONLY)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer c.Wait()
+	var out bytes.Buffer
+	c.Report(&out)
+	if !strings.Contains(out.String(), "has not been waited for") {
+		t.Errorf("report %q", out.String())
+	}
+}
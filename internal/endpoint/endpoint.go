@@ -0,0 +1,313 @@
+// Package endpoint opens the files, sockets, descriptors, processes and terminals that reader, writer and piper
+// read from and write to, and holds the helpers shared by those endpoints.
+package endpoint
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	atExitMu sync.Mutex
+	atExit   []func()
+)
+
+// AtExit registers f to be run by RunAtExit, since os.Exit skips deferred calls.
+func AtExit(f func()) {
+	atExitMu.Lock()
+	defer atExitMu.Unlock()
+	atExit = append(atExit, f)
+}
+
+// RunAtExit runs the functions registered with AtExit, most recently added first.
+func RunAtExit() {
+	atExitMu.Lock()
+	defer atExitMu.Unlock()
+	for i := len(atExit) - 1; i >= 0; i -= 1 {
+		atExit[i]()
+	}
+	atExit = nil
+}
+
+// Options are applied to every connection an endpoint dials or accepts, and the pty fields to pty://
+// endpoints.
+type Options struct {
+	NoDelay string
+	SndBuf  int
+	RcvBuf  int
+	PtyMode string
+	PtyCols int
+	PtyRows int
+}
+
+// bufferedConn is implemented by TCP and Unix socket connections.
+type bufferedConn interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setSocketOptions applies opts to c. TCP_NODELAY only applies to TCP connections.
+func setSocketOptions(c net.Conn, opts Options) error {
+	if tc, ok := c.(*net.TCPConn); ok && opts.NoDelay != "" {
+		if err := tc.SetNoDelay(opts.NoDelay == "on"); err != nil {
+			return fmt.Errorf("could not set TCP_NODELAY: %v", err)
+		}
+	}
+	bc, ok := c.(bufferedConn)
+	if !ok {
+		return nil
+	}
+	if opts.SndBuf != 0 {
+		if err := bc.SetWriteBuffer(opts.SndBuf); err != nil {
+			return fmt.Errorf("could not set SO_SNDBUF: %v", err)
+		}
+	}
+	if opts.RcvBuf != 0 {
+		if err := bc.SetReadBuffer(opts.RcvBuf); err != nil {
+			return fmt.Errorf("could not set SO_RCVBUF: %v", err)
+		}
+	}
+	return nil
+}
+
+// IsURL reports whether name is a socket endpoint rather than a file path.
+func IsURL(name string) bool {
+	return strings.Contains(name, "://")
+}
+
+// IsUDP reports whether name is a udp:// or udp-listen:// endpoint.
+func IsUDP(name string) bool {
+	return strings.HasPrefix(name, "udp://") || strings.HasPrefix(name, "udp-listen://")
+}
+
+// Open opens name with flag. Besides file paths, name may be tcp://host:port to connect, or
+// tcp-listen://[host]:port to accept as many connections as accepts says. unix:// and unix-listen:// do the same
+// for a stream Unix socket path, and unixpacket:// and unixpacket-listen:// for a seqpacket one; paths starting
+// with @ are in the abstract namespace. udp://host:port and udp-listen://[host]:port exchange datagrams; a reading udp:// endpoint
+// sends an empty datagram to announce itself, which a writing udp-listen:// endpoint waits for to learn its peer.
+func Open(name string, flag int, accepts int, opts Options) (io.ReadWriteCloser, error) {
+	switch {
+	case strings.HasPrefix(name, "tcp://"):
+		c, err := net.Dial("tcp", strings.TrimPrefix(name, "tcp://"))
+		if err != nil {
+			return nil, err
+		}
+		return c, setSocketOptions(c, opts)
+	case strings.HasPrefix(name, "tcp-listen://"):
+		ln, err := net.Listen("tcp", strings.TrimPrefix(name, "tcp-listen://"))
+		if err != nil {
+			return nil, err
+		}
+		return listen(ln, flag, accepts, opts)
+	case strings.HasPrefix(name, "unix://"), strings.HasPrefix(name, "unixpacket://"):
+		network, path, _ := strings.Cut(name, "://")
+		c, err := net.Dial(network, path)
+		if err != nil {
+			return nil, err
+		}
+		return c, setSocketOptions(c, opts)
+	case strings.HasPrefix(name, "unix-listen://"), strings.HasPrefix(name, "unixpacket-listen://"):
+		network, path, _ := strings.Cut(name, "-listen://")
+		if !strings.HasPrefix(path, "@") {
+			if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+		}
+		ln, err := net.Listen(network, path)
+		if err != nil {
+			return nil, err
+		}
+		AtExit(func() { ln.Close() })
+		return listen(ln, flag, accepts, opts)
+	case strings.HasPrefix(name, "udp://"):
+		c, err := net.Dial("udp", strings.TrimPrefix(name, "udp://"))
+		if err != nil {
+			return nil, err
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			if _, err := c.Write(nil); err != nil {
+				return nil, err
+			}
+		}
+		return c, setSocketOptions(c, opts)
+	case strings.HasPrefix(name, "udp-listen://"):
+		addr, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(name, "udp-listen://"))
+		if err != nil {
+			return nil, err
+		}
+		c, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := setSocketOptions(c, opts); err != nil {
+			return nil, err
+		}
+		if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+			return c, nil
+		}
+		_, peer, err := c.ReadFrom(make([]byte, 1))
+		if err != nil {
+			return nil, err
+		}
+		return &udpPeer{UDPConn: c, peer: peer}, nil
+	case strings.HasPrefix(name, "fd://"):
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "fd://"))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid descriptor in '%s'", name)
+		}
+		var st syscall.Stat_t
+		if err := syscall.Fstat(n, &st); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		f := os.NewFile(uintptr(n), name)
+		if st.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+			return f, nil
+		}
+		// FileConn works on a duplicate, so sockets get deadlines, shutdown and socket options like dialed ones.
+		// The original is closed now rather than whenever its finalizer runs.
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		return c, setSocketOptions(c, opts)
+	case strings.HasPrefix(name, "exec://"):
+		c, err := startChild(name, flag)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case strings.HasPrefix(name, "pty://"):
+		p, err := openPty(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	case IsURL(name):
+		return nil, fmt.Errorf("unsupported endpoint '%s'", name)
+	default:
+		return os.OpenFile(name, flag, 0755)
+	}
+}
+
+// FdType describes the descriptor of an fd://N endpoint by the file type in its fstat mode. It must be called
+// before Open, which closes the descriptor of a socket once it has a duplicate.
+func FdType(name string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(name, "fd://"))
+	if err != nil {
+		return "unknown"
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(n, &st); err != nil {
+		return err.Error()
+	}
+	kinds := map[uint32]string{syscall.S_IFIFO: "pipe", syscall.S_IFSOCK: "socket", syscall.S_IFREG: "regular file",
+		syscall.S_IFCHR: "character device", syscall.S_IFBLK: "block device", syscall.S_IFDIR: "directory"}
+	kind, ok := kinds[st.Mode&syscall.S_IFMT]
+	if !ok {
+		kind = "unknown"
+	}
+	return fmt.Sprintf("%s (mode %#o)", kind, st.Mode)
+}
+
+// udpPeer sends datagrams from a listening UDP socket to the peer that announced itself.
+type udpPeer struct {
+	*net.UDPConn
+	peer net.Addr
+}
+
+func (u *udpPeer) Write(p []byte) (int, error) {
+	return u.WriteTo(p, u.peer)
+}
+
+// listen accepts connections from ln. A single connection is returned as is; for more, a ConnGroup is returned that
+// accepts them all up front when writing, or one at a time as each reaches EOF when reading.
+func listen(ln net.Listener, flag int, accepts int, opts Options) (io.ReadWriteCloser, error) {
+	g := &ConnGroup{ln: ln, pending: accepts, opts: opts}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 || accepts == 1 {
+		for g.pending > 0 {
+			if err := g.accept(); err != nil {
+				g.Close()
+				return nil, err
+			}
+		}
+	}
+	if accepts == 1 {
+		ln.Close()
+		return g.conns[0], nil
+	}
+	return g, nil
+}
+
+// ConnGroup spreads I/O over several connections accepted from one listener. Reads drain each connection in turn,
+// and writes go to every connection.
+type ConnGroup struct {
+	ln      net.Listener
+	opts    Options
+	pending int
+	conns   []net.Conn
+	cur     int
+}
+
+func (g *ConnGroup) accept() error {
+	c, err := g.ln.Accept()
+	if err != nil {
+		return err
+	}
+	g.pending -= 1
+	g.conns = append(g.conns, c)
+	return setSocketOptions(c, g.opts)
+}
+
+func (g *ConnGroup) Read(p []byte) (int, error) {
+	for {
+		if g.cur == len(g.conns) {
+			if g.pending == 0 {
+				return 0, io.EOF
+			}
+			if err := g.accept(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := g.conns[g.cur].Read(p)
+		if err == io.EOF {
+			g.conns[g.cur].Close()
+			g.cur += 1
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (g *ConnGroup) Write(p []byte) (int, error) {
+	var n int
+	var err error
+	for _, c := range g.conns {
+		n, err = c.Write(p)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Conns returns the connections accepted so far.
+func (g *ConnGroup) Conns() []net.Conn {
+	return g.conns
+}
+
+func (g *ConnGroup) Close() error {
+	for _, c := range g.conns {
+		c.Close()
+	}
+	return g.ln.Close()
+}
@@ -0,0 +1,53 @@
+package endpoint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Failure injects a fault into the stream once a byte or op threshold is reached, for -fm.
+type Failure struct {
+	Mode       string
+	AfterBytes int
+	AfterOps   int
+	fired      bool
+}
+
+// Limit caps an op of n bytes so that it stops at the byte threshold.
+func (f *Failure) Limit(n, bytes int) int {
+	if f.Mode != "" && !f.fired && f.AfterBytes > 0 && bytes+n > f.AfterBytes {
+		return f.AfterBytes - bytes
+	}
+	return n
+}
+
+// Due reports whether the failure should be injected now.
+func (f *Failure) Due(bytes, ops int) bool {
+	if f.Mode == "" || f.fired {
+		return false
+	}
+	return (f.AfterBytes > 0 && bytes >= f.AfterBytes) || (f.AfterOps > 0 && ops >= f.AfterOps)
+}
+
+// Inject carries out the failure on rw. kill, exit and hang never return, exit skipping any cleanup just as a
+// crash would; close returns nil so the following ops fail on their own, and error returns the error to report.
+func (f *Failure) Inject(rw io.ReadWriteCloser, bytes, ops int) error {
+	f.fired = true
+	switch f.Mode {
+	case "kill":
+		syscall.Kill(os.Getpid(), syscall.SIGKILL)
+	case "exit":
+		os.Exit(1)
+	case "close":
+		rw.Close()
+		return nil
+	case "hang":
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+	return fmt.Errorf("injected failure after %d bytes and %d ops", bytes, ops)
+}
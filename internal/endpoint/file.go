@@ -0,0 +1,95 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// MakeFIFO creates a named pipe at path unless something already exists there.
+func MakeFIFO(path string) error {
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+	if err := syscall.Mkfifo(path, 0644); err != nil {
+		return fmt.Errorf("could not create FIFO '%s': %v", path, err)
+	}
+	return nil
+}
+
+// RemoveFIFOAtExit removes the named pipe at path on exit, leaving anything that is not a FIFO in place.
+func RemoveFIFOAtExit(path string) {
+	AtExit(func() {
+		if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+			os.Remove(path)
+		}
+	})
+}
+
+// WaitForFile blocks until path exists, is non-empty, or is closed by a process that had it open for writing,
+// as cond says, giving up after timeout unless it is 0. It watches the parent directory with inotify, so a file
+// that is renamed into place or appears before the watch is set up is seen as well, except by closed, which
+// needs the close to happen while waiting.
+func WaitForFile(path, cond string, timeout time.Duration) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("could not watch for %s: %v", path, err)
+	}
+	events := os.NewFile(uintptr(fd), "inotify")
+	defer events.Close()
+	mask := uint32(syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE)
+	if _, err = syscall.InotifyAddWatch(fd, filepath.Dir(path), mask); err != nil {
+		return fmt.Errorf("could not watch for %s: %v", path, err)
+	}
+	if timeout != 0 {
+		events.SetReadDeadline(time.Now().Add(timeout))
+	}
+	ready := func() bool {
+		fi, err := os.Stat(path)
+		return err == nil && (cond == "exists" || (cond == "nonempty" && fi.Size() > 0))
+	}
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for cond == "closed" || !ready() {
+		n, err := events.Read(buf)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("timed out after %s waiting for %s (%s)", timeout.String(), path, cond)
+		} else if err != nil {
+			return fmt.Errorf("could not watch for %s: %v", path, err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+			off += syscall.SizeofInotifyEvent + int(ev.Len)
+			if cond == "closed" && ev.Mask&syscall.IN_CLOSE_WRITE != 0 && strings.TrimRight(string(name), "\x00") == filepath.Base(path) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// PipeCapacity returns the kernel buffer size of the pipe rw, first resizing it with F_SETPIPE_SZ when size is
+// non-zero.
+func PipeCapacity(rw io.ReadWriteCloser, name string, size int) (int, error) {
+	f, ok := rw.(*os.File)
+	if !ok {
+		return 0, fmt.Errorf("%s is not a pipe", name)
+	}
+	if size != 0 {
+		_, _, e := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETPIPE_SZ, uintptr(size))
+		if e != 0 {
+			return 0, fmt.Errorf("could not set pipe size of %s to %d: %v", name, size, e)
+		}
+	}
+	n, _, e := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETPIPE_SZ, 0)
+	if e != 0 {
+		return 0, fmt.Errorf("could not get pipe size of %s: %v", name, e)
+	}
+	return int(n), nil
+}
@@ -0,0 +1,198 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Pty is a pty:// endpoint: the master side of a new pseudo-terminal. Bare pty:// leaves the slave open for
+// another process to use, and pty://command args runs a command, without a shell, with the slave as its
+// controlling terminal, stdin, stdout and stderr.
+type Pty struct {
+	name      string
+	master    *os.File
+	slave     *os.File
+	slavePath string
+	mode      string
+	cols      int
+	rows      int
+	child     *child
+	waited    sync.Once
+}
+
+// ptyHangupDelay is how long a pty's child gets to exit on its own once I/O stops.
+const ptyHangupDelay = time.Second
+
+func ioctl(f *os.File, req uint, arg unsafe.Pointer) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(req), uintptr(arg))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+func openPty(name string, opts Options) (*Pty, error) {
+	// Opened non-blocking so the master goes through the runtime poller and supports read deadlines.
+	fd, err := syscall.Open("/dev/ptmx", syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not open pty: %v", err)
+	}
+	p := &Pty{name: name, master: os.NewFile(uintptr(fd), "/dev/ptmx"), mode: "cooked"}
+	if err = p.setup(opts); err != nil {
+		p.master.Close()
+		if p.slave != nil {
+			p.slave.Close()
+		}
+		return nil, err
+	}
+	return p, nil
+}
+
+// setup opens the slave side, applies opts and starts the command in the pty's name, if any.
+func (p *Pty) setup(opts Options) error {
+	var unlock int32
+	var n uint32
+	if err := ioctl(p.master, syscall.TIOCSPTLCK, unsafe.Pointer(&unlock)); err != nil {
+		return fmt.Errorf("could not unlock pty: %v", err)
+	}
+	if err := ioctl(p.master, syscall.TIOCGPTN, unsafe.Pointer(&n)); err != nil {
+		return fmt.Errorf("could not find pty: %v", err)
+	}
+	p.slavePath = fmt.Sprintf("/dev/pts/%d", n)
+	var err error
+	if p.slave, err = os.OpenFile(p.slavePath, os.O_RDWR|syscall.O_NOCTTY, 0); err != nil {
+		return err
+	}
+	if opts.PtyMode == "raw" {
+		var t syscall.Termios
+		if err = ioctl(p.slave, syscall.TCGETS, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("could not get pty mode: %v", err)
+		}
+		// The same settings as cfmakeraw(3).
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR |
+			syscall.IGNCR | syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB
+		t.Cflag |= syscall.CS8
+		t.Cc[syscall.VMIN], t.Cc[syscall.VTIME] = 1, 0
+		if err = ioctl(p.slave, syscall.TCSETS, unsafe.Pointer(&t)); err != nil {
+			return fmt.Errorf("could not set pty mode: %v", err)
+		}
+		p.mode = "raw"
+	}
+	if opts.PtyCols > 0 {
+		ws := struct{ rows, cols, x, y uint16 }{uint16(opts.PtyRows), uint16(opts.PtyCols), 0, 0}
+		if err = ioctl(p.master, syscall.TIOCSWINSZ, unsafe.Pointer(&ws)); err != nil {
+			return fmt.Errorf("could not set pty window size: %v", err)
+		}
+		p.cols, p.rows = opts.PtyCols, opts.PtyRows
+	}
+	args := strings.Fields(strings.TrimPrefix(p.name, "pty://"))
+	if len(args) == 0 {
+		return nil
+	}
+	c := &child{name: p.name, cmd: exec.Command(args[0], args[1:]...)}
+	c.cmd.Stdin, c.cmd.Stdout, c.cmd.Stderr = p.slave, p.slave, p.slave
+	c.cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if err = c.cmd.Start(); err != nil {
+		return err
+	}
+	c.started = time.Now()
+	AtExit(func() {
+		if c.state == nil {
+			c.cmd.Process.Kill()
+		}
+	})
+	// Only the child holds the slave open now, so reads see EOF once it exits.
+	p.slave.Close()
+	p.child = c
+	return nil
+}
+
+// SlavePath returns the path of the slave side, for another process to open when no command was given.
+func (p *Pty) SlavePath() string {
+	return p.slavePath
+}
+
+// HasChild reports whether the pty runs a command of its own.
+func (p *Pty) HasChild() bool {
+	return p.child != nil
+}
+
+// Read reports the EIO Linux returns once the slave side is closed as EOF.
+func (p *Pty) Read(b []byte) (int, error) {
+	n, err := p.master.Read(b)
+	if errors.Is(err, syscall.EIO) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (p *Pty) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+func (p *Pty) SetReadDeadline(t time.Time) error {
+	return p.master.SetReadDeadline(t)
+}
+
+// CloseWrite sends end of file to the slave side in cooked mode; the second ^D is needed if a line is pending.
+// Raw mode has no way to signal it.
+func (p *Pty) CloseWrite() error {
+	if p.mode == "raw" {
+		return nil
+	}
+	_, err := p.master.Write([]byte{4, 4})
+	return err
+}
+
+// Wait sends end of file to a child still running and discards its output until it exits, hanging up on it by
+// closing the master if it takes longer than ptyHangupDelay. Like child.Wait, only the first call does so.
+func (p *Pty) Wait() {
+	p.waited.Do(func() {
+		if p.child == nil {
+			p.master.Close()
+			p.slave.Close()
+			return
+		}
+		exited := make(chan struct{})
+		go func() {
+			p.child.Wait()
+			close(exited)
+		}()
+		p.CloseWrite()
+		go io.Copy(io.Discard, p.master)
+		select {
+		case <-exited:
+		case <-time.After(ptyHangupDelay):
+		}
+		p.master.Close()
+		<-exited
+	})
+}
+
+func (p *Pty) Close() error {
+	p.Wait()
+	return nil
+}
+
+// Report prints the pty's settings and how its child exited.
+func (p *Pty) Report(out io.Writer) {
+	window := "unset"
+	if p.cols > 0 {
+		window = fmt.Sprintf("%dx%d", p.cols, p.rows)
+	}
+	fmt.Fprintf(out, "Pty %s in %s mode, window %s\n", p.slavePath, p.mode, window)
+	if p.child != nil {
+		p.child.Report(out)
+	}
+}
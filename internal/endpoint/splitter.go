@@ -0,0 +1,109 @@
+package endpoint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Splitter rolls output over to a new file, named from template, every Size bytes, Count writes or Period, and
+// removes the oldest files beyond the last Keep. %d in the template is replaced by a sequence number starting at
+// 0 and %t by the time the file was opened; without either, the sequence number is appended after a dot.
+type Splitter struct {
+	Size, Count, Keep int
+	Period            time.Duration
+	template          string
+	file              *os.File
+	seq               int
+	bytes, ops        int
+	opened            time.Time
+	names             []string
+	removed           int
+}
+
+// Enabled reports whether any of the split limits is set.
+func (s *Splitter) Enabled() bool {
+	return s.Size > 0 || s.Count > 0 || s.Period > 0
+}
+
+// Open returns a copy of the split settings writing to template, with its first file created.
+func (s Splitter) Open(template string) (*Splitter, error) {
+	if !strings.Contains(template, "%d") && !strings.Contains(template, "%t") {
+		template += ".%d"
+	}
+	s.template = template
+	return &s, s.roll()
+}
+
+func (s *Splitter) roll() error {
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	name := strings.Replace(s.template, "%t", now.Format("20060102T150405.000000000"), -1)
+	name = strings.Replace(name, "%d", strconv.Itoa(s.seq), -1)
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	s.file, s.seq, s.bytes, s.ops, s.opened = f, s.seq+1, 0, 0, now
+	s.names = append(s.names, name)
+	for s.Keep > 0 && len(s.names) > s.Keep {
+		if err := os.Remove(s.names[0]); err != nil {
+			return err
+		}
+		s.names = s.names[1:]
+		s.removed += 1
+	}
+	return nil
+}
+
+func (s *Splitter) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write rolls over before writing once the period or write count is reached, and splits p at the size limit so
+// every file but the last holds exactly Size bytes.
+func (s *Splitter) Write(p []byte) (int, error) {
+	if s.ops > 0 && ((s.Period > 0 && time.Since(s.opened) >= s.Period) || (s.Count > 0 && s.ops >= s.Count)) {
+		if err := s.roll(); err != nil {
+			return 0, err
+		}
+	}
+	written := 0
+	for len(p) > 0 {
+		if s.Size > 0 && s.bytes >= s.Size {
+			if err := s.roll(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if s.Size > 0 && len(chunk) > s.Size-s.bytes {
+			chunk = chunk[:s.Size-s.bytes]
+		}
+		n, err := s.file.Write(chunk)
+		s.bytes += n
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	s.ops += 1
+	return written, nil
+}
+
+func (s *Splitter) Close() error {
+	return s.file.Close()
+}
+
+// Report prints how many files were written and which are left.
+func (s *Splitter) Report(out io.Writer) {
+	fmt.Fprintf(out, "Split into %d files, removed %d, kept %s to %s\n", s.seq, s.removed, s.names[0],
+		s.names[len(s.names)-1])
+}
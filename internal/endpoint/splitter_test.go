@@ -0,0 +1,109 @@
+package endpoint
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// splitFiles returns the contents of every file in dir by name.
+func splitFiles(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[e.Name()] = string(data)
+	}
+	return files
+}
+
+func TestSplitterWrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		split    Splitter
+		template string
+		writes   []string
+		files    map[string]string
+	}{
+		{"under the size", Splitter{Size: 10}, "out", []string{"abcd", "efgh"},
+			map[string]string{"out.0": "abcdefgh"}},
+		{"exactly the size", Splitter{Size: 8}, "out", []string{"abcd", "efgh"},
+			map[string]string{"out.0": "abcdefgh"}},
+		{"one byte over", Splitter{Size: 8}, "out", []string{"abcd", "efgh", "i"},
+			map[string]string{"out.0": "abcdefgh", "out.1": "i"}},
+		{"write straddles the size", Splitter{Size: 6}, "out", []string{"abcd", "efgh"},
+			map[string]string{"out.0": "abcdef", "out.1": "gh"}},
+		{"write spans several files", Splitter{Size: 4}, "out", []string{"abcdefghij"},
+			map[string]string{"out.0": "abcd", "out.1": "efgh", "out.2": "ij"}},
+		{"size of one", Splitter{Size: 1}, "out", []string{"abc"},
+			map[string]string{"out.0": "a", "out.1": "b", "out.2": "c"}},
+		{"count", Splitter{Count: 2}, "out", []string{"a", "b", "c", "d", "e"},
+			map[string]string{"out.0": "ab", "out.1": "cd", "out.2": "e"}},
+		{"rolling at the size restarts the count", Splitter{Size: 4, Count: 2}, "out", []string{"abc", "def", "g", "h"},
+			map[string]string{"out.0": "abcd", "out.1": "efg", "out.2": "h"}},
+		{"sequence in the template", Splitter{Size: 2}, "part-%d.log", []string{"abcd"},
+			map[string]string{"part-0.log": "ab", "part-1.log": "cd"}},
+		{"keep", Splitter{Size: 2, Keep: 2}, "out", []string{"abcdefghi"},
+			map[string]string{"out.3": "gh", "out.4": "i"}},
+		{"keep more than written", Splitter{Size: 2, Keep: 5}, "out", []string{"abcd"},
+			map[string]string{"out.0": "ab", "out.1": "cd"}},
+		{"keep one", Splitter{Count: 1, Keep: 1}, "out", []string{"a", "b", "c"},
+			map[string]string{"out.2": "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, err := tt.split.Open(filepath.Join(dir, tt.template))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.writes {
+				if n, err := s.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if files := splitFiles(t, dir); !reflect.DeepEqual(files, tt.files) {
+				t.Errorf("files %v, want %v", files, tt.files)
+			}
+		})
+	}
+}
+
+func TestSplitterReport(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Splitter{Size: 3, Keep: 2}.Open(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Write([]byte(strings.Repeat("x", 14)))
+	s.Close()
+	var out bytes.Buffer
+	s.Report(&out)
+	want := fmt.Sprintf("Split into 5 files, removed 3, kept %s to %s\n", filepath.Join(dir, "out.3"),
+		filepath.Join(dir, "out.4"))
+	if out.String() != want {
+		t.Errorf("report %q, want %q", out.String(), want)
+	}
+	var names []string
+	for name := range splitFiles(t, dir) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"out.3", "out.4"}) {
+		t.Errorf("left %v after pruning", names)
+	}
+}
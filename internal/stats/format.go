@@ -0,0 +1,52 @@
+// Package stats formats byte counts and rates and collects the resource usage and interval statistics that
+// reader, writer and piper report.
+package stats
+
+import (
+	"fmt"
+	"time"
+)
+
+// FormatBytes scales n to the largest IEC (1024) or SI (1000) prefix that keeps it at or above 1.
+func FormatBytes(n float64, units string) string {
+	var base = 1024.0
+	var suffixes = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	if units == "si" {
+		base = 1000
+		suffixes = []string{"B", "kB", "MB", "GB", "TB", "PB"}
+	}
+	i := 0
+	for n >= base && i < len(suffixes)-1 {
+		n /= base
+		i += 1
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, suffixes[i])
+	}
+	return fmt.Sprintf("%.2f %s", n, suffixes[i])
+}
+
+// FormatRate reports bytes and ops per second over d.
+func FormatRate(bytes, ops int, d time.Duration, units, op string) string {
+	if d <= 0 {
+		return "n/a"
+	}
+	bps := float64(bytes) / d.Seconds()
+	return fmt.Sprintf("%.0f B/s (%s/s), %.2f %ss/s", bps, FormatBytes(bps, units), float64(ops)/d.Seconds(), op)
+}
+
+// FormatAverage reports the average number of bytes moved by each op.
+func FormatAverage(bytes, ops int, units, op string) string {
+	if ops == 0 {
+		return fmt.Sprintf("0 %ss", op)
+	}
+	return fmt.Sprintf("%d %ss, average %s per %s", ops, op, FormatBytes(float64(bytes)/float64(ops), units), op)
+}
+
+// SinceStart reports how long after start t occurred, or n/a if t was never recorded.
+func SinceStart(start, t time.Time) string {
+	if t.IsZero() {
+		return "n/a"
+	}
+	return t.Sub(start).String()
+}
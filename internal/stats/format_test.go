@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n     float64
+		units string
+		want  string
+	}{
+		{0, "iec", "0 B"},
+		{1, "iec", "1 B"},
+		{1023, "iec", "1023 B"},
+		{1024, "iec", "1.00 KiB"},
+		{1536, "iec", "1.50 KiB"},
+		{1024*1024 - 1, "iec", "1024.00 KiB"},
+		{1024 * 1024, "iec", "1.00 MiB"},
+		{5 * 1024 * 1024 * 1024, "iec", "5.00 GiB"},
+		{1 << 50, "iec", "1.00 PiB"},
+		{1 << 60, "iec", "1024.00 PiB"},
+		{999, "si", "999 B"},
+		{1000, "si", "1.00 kB"},
+		{1024, "si", "1.02 kB"},
+		{2500000, "si", "2.50 MB"},
+		{1e15, "si", "1.00 PB"},
+		{1e18, "si", "1000.00 PB"},
+		{0.4, "iec", "0 B"},
+	}
+	for _, tt := range tests {
+		if got := FormatBytes(tt.n, tt.units); got != tt.want {
+			t.Errorf("FormatBytes(%v, %q) = %q, want %q", tt.n, tt.units, got, tt.want)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	tests := []struct {
+		bytes, ops int
+		d          time.Duration
+		units, op  string
+		want       string
+	}{
+		{1024, 4, time.Second, "iec", "read", "1024 B/s (1.00 KiB/s), 4.00 reads/s"},
+		{1024, 4, 2 * time.Second, "iec", "write", "512 B/s (512 B/s), 2.00 writes/s"},
+		{3000000, 3, 500 * time.Millisecond, "si", "read", "6000000 B/s (6.00 MB/s), 6.00 reads/s"},
+		{0, 0, time.Second, "iec", "read", "0 B/s (0 B/s), 0.00 reads/s"},
+		{1, 1, 3 * time.Second, "iec", "read", "0 B/s (0 B/s), 0.33 reads/s"},
+		{1024, 4, 0, "iec", "read", "n/a"},
+		{1024, 4, -time.Second, "iec", "read", "n/a"},
+	}
+	for _, tt := range tests {
+		if got := FormatRate(tt.bytes, tt.ops, tt.d, tt.units, tt.op); got != tt.want {
+			t.Errorf("FormatRate(%d, %d, %s, %q, %q) = %q, want %q", tt.bytes, tt.ops, tt.d, tt.units, tt.op, got,
+				tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IntervalLog writes one CSV row of statistics per interval for -csv. It may be shared by both directions of a
+// relay, so its methods are safe for concurrent use.
+type IntervalLog struct {
+	mu        sync.Mutex
+	out       io.Writer
+	interval  time.Duration
+	start     time.Time
+	bytes     int
+	ops       int
+	errors    int
+	latencies []time.Duration
+}
+
+// NewIntervalLog writes the CSV header to out and returns a log whose first interval begins at start.
+func NewIntervalLog(out io.Writer, interval time.Duration, start time.Time) *IntervalLog {
+	fmt.Fprintf(out, "timestamp,bytes,ops,bytes_per_second,p99_latency_us,errors\n")
+	return &IntervalLog{out: out, interval: interval, start: start}
+}
+
+// Record adds one op to the current interval, first writing rows for any intervals that have ended.
+func (l *IntervalLog) Record(now time.Time, bytes int, latency time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for now.Sub(l.start) >= l.interval {
+		l.flushLocked(l.start.Add(l.interval))
+	}
+	l.bytes += bytes
+	l.ops += 1
+	l.latencies = append(l.latencies, latency)
+	if err != nil && err != io.EOF {
+		l.errors += 1
+	}
+}
+
+// Flush writes the row for the interval ending at end and starts the next one.
+func (l *IntervalLog) Flush(end time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.flushLocked(end)
+}
+
+func (l *IntervalLog) flushLocked(end time.Time) {
+	var bps float64
+	if d := end.Sub(l.start); d > 0 {
+		bps = float64(l.bytes) / d.Seconds()
+	}
+	var p99 time.Duration
+	if len(l.latencies) > 0 {
+		sort.Slice(l.latencies, func(i, j int) bool { return l.latencies[i] < l.latencies[j] })
+		p99 = l.latencies[(len(l.latencies)*99+99)/100-1]
+	}
+	fmt.Fprintf(l.out, "%s,%d,%d,%.0f,%d,%d\n", end.Format(time.RFC3339Nano), l.bytes, l.ops, bps, p99.Microseconds(), l.errors)
+	l.start = end
+	l.bytes, l.ops, l.errors = 0, 0, 0
+	l.latencies = l.latencies[:0]
+}
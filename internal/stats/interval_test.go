@@ -0,0 +1,63 @@
+package stats
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntervalLogP99(t *testing.T) {
+	tests := []struct {
+		ops  int
+		want string
+	}{
+		{0, "0"},
+		{1, "1000"},
+		{2, "2000"},
+		{10, "10000"},
+		{99, "99000"},
+		{100, "99000"},
+		{101, "100000"},
+		{200, "198000"},
+		{1000, "990000"},
+	}
+	start := time.Unix(0, 0)
+	for _, tt := range tests {
+		var out bytes.Buffer
+		l := NewIntervalLog(&out, time.Second, start)
+		// Latencies of 1ms to ops ms, recorded out of order.
+		for _, i := range rand.New(rand.NewSource(1)).Perm(tt.ops) {
+			l.Record(start, 1, time.Duration(i+1)*time.Millisecond, nil)
+		}
+		l.Flush(start.Add(time.Second))
+		rows := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if got := strings.Split(rows[1], ",")[4]; got != tt.want {
+			t.Errorf("p99 of %d ops = %sus, want %sus", tt.ops, got, tt.want)
+		}
+	}
+}
+
+func TestIntervalLogRows(t *testing.T) {
+	var out bytes.Buffer
+	start := time.Unix(0, 0).UTC()
+	l := NewIntervalLog(&out, time.Second, start)
+	l.Record(start.Add(100*time.Millisecond), 1000, time.Millisecond, nil)
+	l.Record(start.Add(200*time.Millisecond), 500, 3*time.Millisecond, errors.New("failed"))
+	l.Record(start.Add(300*time.Millisecond), 0, time.Millisecond, io.EOF)
+	// Skips an empty interval, which still gets a row.
+	l.Record(start.Add(2500*time.Millisecond), 4000, 2*time.Millisecond, nil)
+	l.Flush(start.Add(2750 * time.Millisecond))
+	want := []string{
+		"timestamp,bytes,ops,bytes_per_second,p99_latency_us,errors",
+		"1970-01-01T00:00:01Z,1500,3,1500,3000,1",
+		"1970-01-01T00:00:02Z,0,0,0,0,0",
+		"1970-01-01T00:00:02.75Z,4000,1,5333,2000,0",
+	}
+	if got := strings.Split(strings.TrimSpace(out.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rows\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,60 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Usage is a snapshot of the resource counters reported by -ru.
+type Usage struct {
+	Rusage syscall.Rusage
+	io     map[string]int64
+	ioErr  error
+}
+
+// SampleUsage records getrusage and /proc/self/io for the current process.
+func SampleUsage() Usage {
+	var u Usage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &u.Rusage)
+	data, err := os.ReadFile("/proc/self/io")
+	if err != nil {
+		u.ioErr = err
+		return u
+	}
+	u.io = make(map[string]int64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			u.io[strings.TrimSuffix(fields[0], ":")] = v
+		}
+	}
+	return u
+}
+
+// ReportUsage prints the difference between two usage samples.
+func ReportUsage(out io.Writer, before, after Usage) {
+	b, a := before.Rusage, after.Rusage
+	user := time.Duration(syscall.TimevalToNsec(a.Utime) - syscall.TimevalToNsec(b.Utime))
+	sys := time.Duration(syscall.TimevalToNsec(a.Stime) - syscall.TimevalToNsec(b.Stime))
+	fmt.Fprintf(out, "CPU user %s, sys %s; context switches %d voluntary, %d involuntary; page faults %d minor, %d major\n",
+		user.String(), sys.String(), a.Nvcsw-b.Nvcsw, a.Nivcsw-b.Nivcsw, a.Minflt-b.Minflt, a.Majflt-b.Majflt)
+	if after.ioErr != nil {
+		fmt.Fprintf(out, "Kernel I/O counters unavailable: %v\n", after.ioErr)
+		return
+	} else if before.ioErr != nil {
+		fmt.Fprintf(out, "Kernel I/O counters unavailable: %v\n", before.ioErr)
+		return
+	}
+	fmt.Fprintf(out, "Kernel I/O rchar %d, wchar %d, read_bytes %d, write_bytes %d\n", after.io["rchar"]-before.io["rchar"],
+		after.io["wchar"]-before.io["wchar"], after.io["read_bytes"]-before.io["read_bytes"],
+		after.io["write_bytes"]-before.io["write_bytes"])
+}
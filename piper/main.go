@@ -1,22 +1,61 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
+	"net"
 	"os"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"ioTools/internal/endpoint"
+	"ioTools/internal/stats"
 )
 
 const syntaxError = 3
 const runtimeError = 1
 
+// exit runs the endpoint cleanups, since os.Exit skips deferred calls, and exits with rc.
+func exit(rc int) {
+	endpoint.RunAtExit()
+	os.Exit(rc)
+}
+
 func usage(out io.Writer) {
 	s := "Reads data from a file or stdin and writes it to a file or stdout in a pattern depending on several parameters.\n" +
 		"By default, reads from stdin and writes to stdout in 256k blocks until EOF\n" +
-		" -i \tInput file: file path to read from.\n" +
-		" -o \tOutput file: file path to write to.\n" +
+		" -i \tInput file: file path to read from,\n" +
+		"    \tor a socket: tcp://host:port, tcp-listen://[host]:port, unix://path, unix-listen://path,\n" +
+		"    \tunixpacket://path, unixpacket-listen://path, udp://host:port or udp-listen://[host]:port,\n" +
+		"    \tor fd://N for a descriptor inherited from the parent process, or exec://command args to run a command\n" +
+		"    \t(without a shell) and read its stdout or write to its stdin.\n" +
+		"    \tpty:// opens a new pseudo-terminal, logging the path of its slave side for another process to use, and\n" +
+		"    \tpty://command args runs a command with the slave side as its terminal.\n" +
+		"    \tUnix socket paths starting with @ are abstract. Repeat to merge several inputs, using - for stdin.\n" +
+		" -im\tInput Mode: How several inputs are merged. cat reads each to its end in turn, rr takes one block\n" +
+		"    \tfrom each in turn, and any takes blocks from whichever input has data first. Default is cat.\n" +
+		" -o \tOutput file: file path to write to, or any of the socket endpoints accepted by -i. Repeat to copy the\n" +
+		"    \tstream to several outputs, using - for stdout.\n" +
+		" -ss\tSplit Size: Roll each -o file over to a new file every this many bytes. Suffix with k or m. %%d in the\n" +
+		"    \tfile name is replaced by a sequence number and %%t by a timestamp; without either, .N is appended.\n" +
+		" -sc\tSplit Count: Roll each -o file over to a new file every this many writes.\n" +
+		" -st\tSplit Time: Roll each -o file over to a new file at the first write this long after\n" +
+		"    \tthe last roll. Suffix with ms, m, or h.\n" +
+		" -sk\tSplit Keep: Remove the oldest split files so only this many are left.\n" +
+		" -tp\tTee Policy: How several outputs handle a slow or failed one. block writes to each in turn and fails\n" +
+		"    \tif any does; buffer queues up to Tee Buffer bytes for each, waits when a queue is full and drops an\n" +
+		"    \toutput that fails; drop also queues, but drops an output whose queue is full once a write to it has not\n" +
+		"    \treturned for a second. Default is block.\n" +
+		" -tb\tTee Buffer: How many bytes may be queued for each output. Suffix with k or m. Default is 1m.\n" +
 		" -s \tSize: How many bytes to attempt to read and write each iteration. Suffix with k or m for kilobytes or\n" +
 		"    \tmegabytes.\n" +
 		" -c \tCount: How many iterations to try before quitting, unless EOF is reached first.\n" +
@@ -25,9 +64,58 @@ func usage(out io.Writer) {
 		"    \t-o or -i.\n" +
 		" -t \tTimeout: How many seconds (not counting Start Delay) to run before quitting, unless Count is reached\n" +
 		"	 \tfirst. Suffix with ms, m, or h.\n" +
+		" -wf\tWait For: Before opening each -i file, wait until it exists, is nonempty, or is closed by a process that was\n" +
+		"    \twriting it (closed). Uses inotify on the parent directory. Waits after Open Delay.\n" +
+		" -wt\tWait Timeout: How long -wf waits before failing. Suffix with ms, m, or h. Default is forever.\n" +
 		" -sd\tStart Delay: How many seconds to delay before beginning to read and write. Suffix with ms, m, or h.\n" +
 		" -l \tLog File: Filename to log to.\n" +
-		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0." +
+		" -ce\tCopy Engine: How data is moved. rw reads into a buffer and writes it out; splice moves it through a\n" +
+		"    \tkernel pipe, sendfile sends from a regular file, and cfr uses copy_file_range between regular files,\n" +
+		"    \tnone of them copying through this process. auto picks the best the endpoints allow. An engine the\n" +
+		"    \tkernel refuses falls back to the next, and finally to rw. Faults and impairments need rw. Default is rw.\n" +
+		" -bw\tBandwidth: Cap the rate data is written at, in bytes per second. Suffix with k or m for kilobytes or\n" +
+		"    \tmegabytes.\n" +
+		" -rl\tRelay: Copy in both directions between -i and -o, using stdin and stdout for whichever is missing.\n" +
+		"    \tSize, Count and Timeout apply to each direction.\n" +
+		" -rd\tReverse Delay: Delay between iterations copying from -o back to -i in relay mode. Suffix with ms, m,\n" +
+		"    \tor h.\n" +
+		" -rbw\tReverse Bandwidth: Bandwidth cap copying from -o back to -i in relay mode.\n" +
+		" -hc\tHalf Close: What relay mode does when one direction ends. half shuts down writing to the other side and\n" +
+		"    \tkeeps copying the opposite direction until it ends too; full closes both sides. Default is half.\n" +
+		" -lat\tLatency: Hold each chunk for this long before writing it, reading on meanwhile. Suffix with ms, m,\n" +
+		"    \tor h.\n" +
+		" -jit\tJitter: Vary each chunk's latency by up to this much either way, keeping chunks in order. Suffix\n" +
+		"    \twith ms, m, or h.\n" +
+		" -fr\tFragment: Split each chunk into writes of a random size up to this many bytes. Suffix with k or m.\n" +
+		" -rst\tReset: Reset the connections once this many bytes have been written. Suffix with k or m.\n" +
+		" -rp\tReset Probability: Chance from 0 to 1 of resetting after each chunk once -rst is reached. Default is 1.\n" +
+		" -bf\tBit Flips: Chance from 0 to 1 of flipping a random bit in each byte read from -i.\n" +
+		" -drop\tDrop: Leave out the comma-separated offset:length ranges of bytes read from -i, e.g. 0:16,1m:4k.\n" +
+		" -dup\tDuplicate: Chance from 0 to 1 of writing each chunk read from -i twice.\n" +
+		" -ro\tReorder: Chance from 0 to 1 of holding a chunk read from -i back until after the next one.\n" +
+		" -tr\tTruncate: End the stream after this many bytes of -i. Suffix with k or m.\n" +
+		" -gb\tGarbage: Chance from 0 to 1 of writing random bytes before each chunk read from -i.\n" +
+		" -fl\tFault Log: Log each injected fault to this file as CSV. Defaults to the log file.\n" +
+		" -seed\tSeed: Seed for jitter, fragmentation, resets and faults. Defaults to the current time; printed in the summary.\n" +
+		" -n \tConnections: How many connections a listening endpoint accepts. Input drains each connection in turn; output\n" +
+		"    \tgets every block on every connection. Default is 1.\n" +
+		" -nd\tNo Delay: Set TCP_NODELAY on or off for TCP connections. Defaults to the Go runtime's setting (on).\n" +
+		" -sb\tSend Buffer: SO_SNDBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -rb\tReceive Buffer: SO_RCVBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -pm\tPty Mode: Line discipline of pty:// endpoints, raw or cooked. Default is cooked.\n" +
+		" -pw\tPty Window: Window size of pty:// endpoints as COLSxROWS, such as 80x24.\n" +
+		" -mf\tMake FIFO: Create a named pipe at -i and -o if nothing exists there.\n" +
+		" -rf\tRemove FIFO: Remove the named pipe at -i and -o on exit. Anything other than a FIFO is left in place.\n" +
+		" -pq\tPipe Query: Report the kernel buffer size of the input and output pipes in the summary.\n" +
+		" -ps\tPipe Size: Resize the kernel buffer of the input and output pipes with F_SETPIPE_SZ. Suffix with k or m\n" +
+		"    \tfor kilobytes or megabytes. Implies -pq.\n" +
+		" -csv\tCSV Log: Write one row per interval (timestamp, bytes, ops, throughput, p99 latency of each\n" +
+		"    \tread and its write, errors) to this file.\n" +
+		" -ci\tCSV Interval: How many seconds each CSV row covers. Suffix with ms, m, or h. Default is 1.\n" +
+		" -ru\tResource Usage: Include CPU time, context switches, page faults and kernel I/O counters\n" +
+		"    \t(/proc/self/io) in the summary.\n" +
+		" -u \tUnits: Unit prefixes used in the summary, either iec (KiB, MiB, ...) or si (kB, MB, ...). Default is iec.\n" +
+		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0.\n" +
 		" -h \tHelp: Prints this text\n" +
 		"Returns 0 on success, 1 if a runtime error is encountered, 3 if bad arguments are passed.\n"
 	fmt.Fprintf(out, s)
@@ -40,15 +128,1182 @@ func handleError(err error, out io.Writer, rc int) {
 	} else {
 		fmt.Fprintf(out, "%v\n", err)
 	}
-	os.Exit(rc)
+	exit(rc)
+}
+
+// parseSize parses a number of bytes, suffixed with k or m for kilobytes or megabytes.
+func parseSize(arg string) (int, error) {
+	var mult = 1
+	var s string
+	if strings.HasSuffix(arg, "k") {
+		mult = 1024
+		s = strings.TrimSuffix(arg, "k")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = 1024 * 1024
+		s = strings.TrimSuffix(arg, "m")
+	} else {
+		s = arg
+	}
+	sz, err := strconv.ParseInt(s, 10, 32)
+	return int(sz) * mult, err
+}
+
+// parseDuration parses a number of seconds, suffixed with ms, m, or h for milliseconds, minutes or hours.
+func parseDuration(arg string) (time.Duration, error) {
+	var mult = time.Second
+	var s string
+	if strings.HasSuffix(arg, "ms") {
+		mult = time.Millisecond
+		s = strings.TrimSuffix(arg, "ms")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = time.Minute
+		s = strings.TrimSuffix(arg, "m")
+	} else if strings.HasSuffix(arg, "h") {
+		mult = time.Hour
+		s = strings.TrimSuffix(arg, "h")
+	} else {
+		s = arg
+	}
+	t, err := strconv.ParseInt(s, 10, 32)
+	return time.Duration(t) * mult, err
+}
+
+// stdio joins stdin and stdout into one endpoint for relay mode.
+type stdio struct{}
+
+func (stdio) Read(p []byte) (int, error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdio) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdio) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
+
+// closeWrite ends the writing half of rw, closing it outright when it cannot be half-closed.
+func closeWrite(rw io.ReadWriteCloser) error {
+	switch c := rw.(type) {
+	case interface{ CloseWrite() error }:
+		return c.CloseWrite()
+	case stdio:
+		return os.Stdout.Close()
+	case *endpoint.ConnGroup:
+		for _, conn := range c.Conns() {
+			closeWrite(conn)
+		}
+		return nil
+	default:
+		return rw.Close()
+	}
+}
+
+// impairment describes the bad link a pump emulates while writing.
+type impairment struct {
+	latency    time.Duration
+	jitter     time.Duration
+	fragment   int
+	resetAfter int
+	resetProb  float64
+}
+
+// inFlight is a chunk held back by the emulated link latency.
+type inFlight struct {
+	data    []byte
+	readAt  time.Time
+	itrTime time.Time
+}
+
+// inFlightChunks bounds how many chunks the emulated link holds before reading stalls.
+const inFlightChunks = 4096
+
+// merge reads several inputs as one stream. The cat mode reads each input to its end in turn, rr takes one read
+// from each input in turn, and any has a goroutine read each input and hands over whichever block arrives first.
+type merge struct {
+	sources  []*source
+	mode     string
+	cur      int
+	live     int
+	arrivals chan arrival
+	leftover []byte
+}
+
+// source is one input of a merge.
+type source struct {
+	name     string
+	in       io.ReadWriteCloser
+	bytes    int
+	reads    int
+	done     bool
+	finished time.Time
+}
+
+// arrival is a block read from a source by the any mode.
+type arrival struct {
+	src  *source
+	data []byte
+	err  error
+}
+
+func newMerge(inputs []io.ReadWriteCloser, names []string, mode string, size int) *merge {
+	m := &merge{mode: mode, live: len(inputs)}
+	for i, in := range inputs {
+		m.sources = append(m.sources, &source{name: names[i], in: in})
+	}
+	if mode == "any" {
+		m.arrivals = make(chan arrival)
+		for _, src := range m.sources {
+			go func(src *source) {
+				for {
+					buf := make([]byte, size)
+					n, err := src.in.Read(buf)
+					m.arrivals <- arrival{src: src, data: buf[:n], err: err}
+					if err != nil {
+						return
+					}
+				}
+			}(src)
+		}
+	}
+	return m
+}
+
+// record accounts for a read from src, returning the error the merge should report.
+func (m *merge) record(src *source, n int, err error) error {
+	src.bytes += n
+	src.reads += 1
+	if err == io.EOF {
+		src.done = true
+		src.finished = time.Now()
+		m.live -= 1
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: %w", src.name, err)
+	}
+	return nil
+}
+
+func (m *merge) Read(p []byte) (int, error) {
+	if len(m.leftover) > 0 {
+		n := copy(p, m.leftover)
+		m.leftover = m.leftover[n:]
+		return n, nil
+	}
+	for m.live > 0 {
+		if m.mode == "any" {
+			a := <-m.arrivals
+			if err := m.record(a.src, len(a.data), a.err); err != nil {
+				return 0, err
+			}
+			n := copy(p, a.data)
+			m.leftover = a.data[n:]
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		src := m.sources[m.cur]
+		if src.done {
+			m.cur = (m.cur + 1) % len(m.sources)
+			continue
+		}
+		n, err := src.in.Read(p)
+		if err := m.record(src, n, err); err != nil {
+			return n, err
+		}
+		if m.mode == "rr" || src.done {
+			m.cur = (m.cur + 1) % len(m.sources)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+func (m *merge) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("merged inputs cannot be written")
+}
+
+// SetReadDeadline applies the deadline to every input that supports one.
+func (m *merge) SetReadDeadline(t time.Time) error {
+	for _, src := range m.sources {
+		if d, ok := src.in.(interface{ SetReadDeadline(time.Time) error }); ok {
+			d.SetReadDeadline(t)
+		}
+	}
+	return nil
+}
+
+func (m *merge) Close() error {
+	for _, src := range m.sources {
+		src.in.Close()
+	}
+	return nil
+}
+
+// report prints how much was read from each input and when it reached its end.
+func (m *merge) report(out io.Writer, start time.Time, units string) {
+	for _, src := range m.sources {
+		fmt.Fprintf(out, "Input %s: read %d bytes (%s) in %d reads, end after %s\n",
+			src.name, src.bytes, stats.FormatBytes(float64(src.bytes), units), src.reads, stats.SinceStart(start, src.finished))
+	}
+}
+
+// tee copies the stream to several outputs. With the block policy each write goes to every output in turn and
+// fails if any of them does. Otherwise each output has a queue of up to limit bytes, drained by its own goroutine;
+// when a queue is full the buffer policy waits for it, and so does the drop policy unless the output has been
+// stuck in a write for stall, in which case that output is dropped. Either policy drops an output whose write
+// fails.
+type tee struct {
+	branches []*branch
+	policy   string
+	limit    int
+	stall    time.Duration
+}
+
+// teeStall is how long a write to a tee output may go without returning before the drop policy gives up on it.
+const teeStall = time.Second
+
+// branch is one output of a tee.
+type branch struct {
+	name         string
+	out          io.ReadWriteCloser
+	mu           sync.Mutex
+	cond         *sync.Cond
+	pending      [][]byte
+	pendingBytes int
+	closed       bool
+	done         chan struct{}
+	writing      time.Time
+	bytes        int
+	dropped      string
+}
+
+func newTee(outputs []io.ReadWriteCloser, names []string, policy string, limit int) *tee {
+	t := &tee{policy: policy, limit: limit, stall: teeStall}
+	for i, o := range outputs {
+		b := &branch{name: names[i], out: o}
+		b.cond = sync.NewCond(&b.mu)
+		if policy != "block" {
+			b.done = make(chan struct{})
+			go b.run()
+		}
+		t.branches = append(t.branches, b)
+	}
+	return t
+}
+
+// run writes the branch's queue to its output until the tee is closed or the output fails.
+func (b *branch) run() {
+	defer close(b.done)
+	for {
+		b.mu.Lock()
+		for len(b.pending) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.pending) == 0 || b.dropped != "" {
+			b.mu.Unlock()
+			return
+		}
+		p := b.pending[0]
+		b.writing = time.Now()
+		b.mu.Unlock()
+		n, err := b.out.Write(p)
+		b.mu.Lock()
+		b.writing = time.Time{}
+		b.bytes += n
+		if b.dropped != "" {
+			b.mu.Unlock()
+			return
+		}
+		b.pending = b.pending[1:]
+		b.pendingBytes -= len(p)
+		if err != nil {
+			b.drop(fmt.Sprintf("dropped after error: %v", err))
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// stalled reports how long the branch's current write has gone without returning. b.mu must be held.
+func (b *branch) stalled() time.Duration {
+	if b.writing.IsZero() {
+		return 0
+	}
+	return time.Since(b.writing)
+}
+
+// drop removes the branch from the tee, discarding its queue. b.mu must be held.
+func (b *branch) drop(reason string) {
+	b.dropped = reason
+	b.pending = nil
+	b.pendingBytes = 0
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (t *tee) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (t *tee) Write(p []byte) (int, error) {
+	live := 0
+	for _, b := range t.branches {
+		if t.policy == "block" {
+			n, err := b.out.Write(p)
+			b.bytes += n
+			if err != nil {
+				return n, fmt.Errorf("%s: %v", b.name, err)
+			}
+			live += 1
+			continue
+		}
+		b.mu.Lock()
+		for b.dropped == "" && b.pendingBytes > 0 && b.pendingBytes+len(p) > t.limit {
+			if t.policy == "buffer" {
+				b.cond.Wait()
+				continue
+			}
+			stalled := b.stalled()
+			if stalled >= t.stall {
+				b.drop(fmt.Sprintf("dropped with %d bytes queued after a write stalled for %s", b.pendingBytes,
+					stalled.Round(time.Millisecond).String()))
+				go b.out.Close()
+				break
+			}
+			// Wake up when the write in progress is due to be judged stuck, if it has not returned by then.
+			wake := time.AfterFunc(t.stall-stalled, func() {
+				b.mu.Lock()
+				b.cond.Broadcast()
+				b.mu.Unlock()
+			})
+			b.cond.Wait()
+			wake.Stop()
+		}
+		if b.dropped == "" {
+			b.pending = append(b.pending, append([]byte(nil), p...))
+			b.pendingBytes += len(p)
+			b.cond.Broadcast()
+			live += 1
+		}
+		b.mu.Unlock()
+	}
+	if live == 0 {
+		return 0, fmt.Errorf("every output has been dropped")
+	}
+	return len(p), nil
+}
+
+// wait lets every branch still in the tee finish writing its queue. A dropped branch may be stuck in a write to
+// its output, so it is not waited for.
+func (t *tee) wait() {
+	for _, b := range t.branches {
+		if b.done == nil {
+			continue
+		}
+		b.mu.Lock()
+		b.closed = true
+		b.cond.Broadcast()
+		dropped := b.dropped != ""
+		b.mu.Unlock()
+		if !dropped {
+			<-b.done
+		}
+	}
+}
+
+func (t *tee) Close() error {
+	t.wait()
+	for _, b := range t.branches {
+		b.out.Close()
+	}
+	return nil
+}
+
+// report prints how much each output was sent and whether it was dropped.
+func (t *tee) report(out io.Writer, units string) {
+	for _, b := range t.branches {
+		b.mu.Lock()
+		fmt.Fprintf(out, "Output %s: wrote %d bytes (%s)", b.name, b.bytes, stats.FormatBytes(float64(b.bytes), units))
+		if b.dropped != "" {
+			fmt.Fprintf(out, ", %s", b.dropped)
+		}
+		fmt.Fprintf(out, "\n")
+		b.mu.Unlock()
+	}
+}
+
+// spliceMove is the SPLICE_F_MOVE flag of splice(2), which the syscall package does not define.
+const spliceMove = 0x1
+
+// copyFileRangeTrap is the copy_file_range(2) system call number on each architecture, which the syscall package
+// does not define. Other architectures fall back to another engine.
+var copyFileRangeTrap = map[string]uintptr{"amd64": 326, "386": 377, "arm64": 285, "arm": 391, "riscv64": 285,
+	"loong64": 285, "ppc64": 379, "ppc64le": 379, "s390x": 375}
+
+// copyEngine moves data from one descriptor to another without copying it through this process. move moves up
+// to n bytes, returning io.EOF once the input is exhausted.
+type copyEngine struct {
+	name  string
+	move  func(n int) (int, error)
+	close func()
+}
+
+// rawConn returns the descriptor behind an endpoint that has one, and whether it is a regular file.
+func rawConn(v interface{}) (syscall.RawConn, int, bool, error) {
+	sc, ok := v.(syscall.Conn)
+	if !ok {
+		return nil, 0, false, fmt.Errorf("endpoint has no file descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var fd int
+	if err = rc.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return nil, 0, false, err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return nil, 0, false, err
+	}
+	return rc, fd, st.Mode&syscall.S_IFMT == syscall.S_IFREG, nil
+}
+
+// engineCandidates lists the engines to try for engine, which auto picks from by the kinds of endpoint, best
+// first.
+func engineCandidates(engine string, in io.Reader, out io.Writer) []string {
+	if engine != "auto" {
+		return []string{engine}
+	}
+	_, _, inFile, inErr := rawConn(in)
+	_, _, outFile, outErr := rawConn(out)
+	switch {
+	case inErr != nil || outErr != nil:
+		return nil
+	case inFile && outFile:
+		return []string{"cfr", "sendfile", "splice"}
+	case inFile:
+		return []string{"sendfile", "splice"}
+	default:
+		return []string{"splice"}
+	}
+}
+
+// newEngine sets up engine between in and out. Whether the kernel supports it for these descriptors is only
+// known once move is first called.
+func newEngine(engine string, in io.Reader, out io.Writer) (*copyEngine, error) {
+	inRC, inFd, inFile, err := rawConn(in)
+	if err != nil {
+		return nil, err
+	}
+	outRC, outFd, outFile, err := rawConn(out)
+	if err != nil {
+		return nil, err
+	}
+	e := &copyEngine{name: engine, close: func() {}}
+	switch engine {
+	case "splice":
+		var pipe [2]int
+		if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC); err != nil {
+			return nil, err
+		}
+		e.close = func() {
+			syscall.Close(pipe[0])
+			syscall.Close(pipe[1])
+		}
+		e.move = func(n int) (int, error) {
+			var moved int64
+			var err error
+			rerr := inRC.Read(func(fd uintptr) bool {
+				moved, err = syscall.Splice(int(fd), nil, pipe[1], nil, n, spliceMove)
+				return err != syscall.EAGAIN
+			})
+			if err == nil {
+				err = rerr
+			}
+			if err != nil || moved == 0 {
+				if err == nil {
+					err = io.EOF
+				}
+				return 0, err
+			}
+			// Drain the pipe completely, so it never holds data across calls.
+			var written int64
+			for written < moved {
+				var m int64
+				werr := outRC.Write(func(fd uintptr) bool {
+					m, err = syscall.Splice(pipe[0], nil, int(fd), nil, int(moved-written), spliceMove)
+					return err != syscall.EAGAIN
+				})
+				if err == nil {
+					err = werr
+				}
+				if err != nil {
+					if unsupported(err) {
+						// The output cannot be spliced to, but what left the input is in the pipe, so write it
+						// out the ordinary way rather than lose it.
+						m, werr := drainPipe(pipe[0], out, int(moved-written))
+						written += int64(m)
+						if werr != nil {
+							err = werr
+						}
+					}
+					return int(written), err
+				}
+				written += m
+			}
+			return int(written), nil
+		}
+	case "sendfile":
+		if !inFile {
+			return nil, fmt.Errorf("sendfile needs a regular file as input")
+		}
+		e.move = func(n int) (int, error) {
+			var moved int
+			var err error
+			werr := outRC.Write(func(fd uintptr) bool {
+				moved, err = syscall.Sendfile(int(fd), inFd, nil, n)
+				return err != syscall.EAGAIN
+			})
+			if err == nil {
+				err = werr
+			}
+			if err != nil {
+				// Sendfile returns -1 along with the error.
+				return 0, err
+			}
+			if moved == 0 {
+				err = io.EOF
+			}
+			return moved, err
+		}
+	case "cfr":
+		trap, ok := copyFileRangeTrap[runtime.GOARCH]
+		if !ok {
+			return nil, fmt.Errorf("copy_file_range is not available on %s", runtime.GOARCH)
+		}
+		if !inFile || !outFile {
+			return nil, fmt.Errorf("copy_file_range needs regular files")
+		}
+		e.move = func(n int) (int, error) {
+			moved, _, errno := syscall.Syscall6(trap, uintptr(inFd), 0, uintptr(outFd), 0, uintptr(n), 0)
+			if errno != 0 {
+				return 0, errno
+			}
+			if moved == 0 {
+				return 0, io.EOF
+			}
+			return int(moved), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown copy engine '%s'", engine)
+	}
+	return e, nil
+}
+
+// drainPipe writes the n bytes waiting in the pipe read from fd to out.
+func drainPipe(fd int, out io.Writer, n int) (int, error) {
+	buf := make([]byte, n)
+	for got := 0; got < n; {
+		m, err := syscall.Read(fd, buf[got:])
+		if err != nil {
+			return 0, err
+		}
+		got += m
+	}
+	return out.Write(buf)
+}
+
+// unsupported reports whether err from an engine's first move means the kernel cannot use it for these
+// descriptors, rather than that the copy failed.
+func unsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EXDEV) ||
+		errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EBADF)
+}
+
+// byteRange is a span of the input stream.
+type byteRange struct {
+	offset int
+	length int
+}
+
+// faultEvent is one injected fault, positioned relative to the start of the piece it is in until that piece is
+// written and its output offset is known.
+type faultEvent struct {
+	rel    int
+	in     int
+	kind   string
+	length int
+	detail string
+}
+
+// piece is a span of output along with the faults injected into it.
+type piece struct {
+	data   []byte
+	events []faultEvent
+}
+
+// faults corrupts the stream read by a pump in seeded, reproducible ways and logs each fault as a CSV row of
+// input offset, output offset, fault, length and detail.
+type faults struct {
+	bitFlipRate float64
+	drops       []byteRange
+	dupProb     float64
+	reorderProb float64
+	truncateAt  int
+	garbageProb float64
+	rng         *rand.Rand
+	log         io.Writer
+
+	inOffset   int
+	outOffset  int
+	gap        int
+	held       []*piece
+	heldIn     int
+	heldLength int
+	counts     map[string]int
+}
+
+func newFaults(f faults, seed int64, log io.Writer) *faults {
+	f.rng = rand.New(rand.NewSource(seed))
+	f.log = log
+	f.gap = -1
+	f.counts = make(map[string]int)
+	fmt.Fprintf(log, "input_offset,output_offset,fault,length,detail\n")
+	return &f
+}
+
+// enabled reports whether any fault is configured.
+func (f *faults) enabled() bool {
+	return f.bitFlipRate > 0 || len(f.drops) > 0 || f.dupProb > 0 || f.reorderProb > 0 || f.truncateAt >= 0 ||
+		f.garbageProb > 0
+}
+
+// apply returns what to write in place of chunk, and whether the stream has been truncated.
+func (f *faults) apply(chunk []byte) ([][]byte, bool) {
+	in := f.inOffset
+	f.inOffset += len(chunk)
+	var truncated bool
+	if f.truncateAt >= 0 && in+len(chunk) >= f.truncateAt {
+		chunk = chunk[:f.truncateAt-in]
+		truncated = true
+	}
+	p := &piece{}
+	pos := 0
+	for _, r := range f.drops {
+		from, to := r.offset-in, r.offset+r.length-in
+		if from < pos {
+			from = pos
+		}
+		if to > len(chunk) {
+			to = len(chunk)
+		}
+		if from >= to {
+			continue
+		}
+		f.flipBits(chunk[pos:from], in+pos, p)
+		p.data = append(p.data, chunk[pos:from]...)
+		p.events = append(p.events, faultEvent{rel: len(p.data), in: in + from, kind: "drop", length: to - from})
+		pos = to
+	}
+	f.flipBits(chunk[pos:], in+pos, p)
+	p.data = append(p.data, chunk[pos:]...)
+	if truncated {
+		p.events = append(p.events, faultEvent{rel: len(p.data), in: f.truncateAt, kind: "truncate"})
+	}
+
+	group := []*piece{p}
+	if len(p.data) > 0 && f.garbageProb > 0 && f.rng.Float64() < f.garbageProb {
+		g := make([]byte, 1+f.rng.Intn(len(p.data)))
+		f.rng.Read(g)
+		group = []*piece{{data: g, events: []faultEvent{{in: in, kind: "garbage", length: len(g)}}}, p}
+	}
+	if len(p.data) > 0 && f.dupProb > 0 && f.rng.Float64() < f.dupProb {
+		group = append(group, &piece{data: p.data, events: []faultEvent{{in: in, kind: "duplicate", length: len(p.data)}}})
+	}
+	if f.held != nil {
+		f.held[0].events = append(f.held[0].events, faultEvent{in: f.heldIn, kind: "reorder", length: f.heldLength,
+			detail: fmt.Sprintf("written after input offset %d", in)})
+		group = append(group, f.held...)
+		f.held = nil
+	} else if !truncated && len(p.data) > 0 && f.reorderProb > 0 && f.rng.Float64() < f.reorderProb {
+		f.held, f.heldIn, f.heldLength = group, in, len(chunk)
+		return nil, false
+	}
+	return f.emit(group), truncated
+}
+
+// flush returns the chunk held back for reordering, if the stream ends before anything could overtake it.
+func (f *faults) flush() [][]byte {
+	group := f.held
+	f.held = nil
+	return f.emit(group)
+}
+
+// flipBits flips one random bit in bytes of seg at the configured rate. The gaps between flips follow a geometric
+// distribution and carry over from one segment to the next.
+func (f *faults) flipBits(seg []byte, in int, p *piece) {
+	if f.bitFlipRate <= 0 {
+		return
+	}
+	i := 0
+	for {
+		if f.gap < 0 {
+			f.gap = 0
+			if f.bitFlipRate < 1 {
+				f.gap = int(math.Log(1-f.rng.Float64()) / math.Log(1-f.bitFlipRate))
+			}
+		}
+		if i+f.gap >= len(seg) {
+			f.gap -= len(seg) - i
+			return
+		}
+		i += f.gap
+		f.gap = -1
+		bit := f.rng.Intn(8)
+		seg[i] ^= 1 << bit
+		p.events = append(p.events, faultEvent{rel: len(p.data) + i, in: in + i, kind: "bitflip", length: 1,
+			detail: fmt.Sprintf("bit %d", bit)})
+		i += 1
+	}
+}
+
+// emit logs the faults in pieces now that their output offsets are known.
+func (f *faults) emit(pieces []*piece) [][]byte {
+	var out [][]byte
+	for _, p := range pieces {
+		for _, e := range p.events {
+			fmt.Fprintf(f.log, "%d,%d,%s,%d,%s\n", e.in, f.outOffset+e.rel, e.kind, e.length, e.detail)
+			f.counts[e.kind] += 1
+		}
+		f.outOffset += len(p.data)
+		out = append(out, p.data)
+	}
+	return out
+}
+
+// report prints how many of each fault were injected.
+func (f *faults) report(out io.Writer) {
+	var kinds []string
+	for k := range f.counts {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	var counts []string
+	for _, k := range kinds {
+		counts = append(counts, fmt.Sprintf("%d %s", f.counts[k], k))
+	}
+	if len(counts) == 0 {
+		counts = []string{"none"}
+	}
+	fmt.Fprintf(out, "Faults injected: %s\n", strings.Join(counts, ", "))
+}
+
+// parseRanges parses a comma-separated list of offset:length byte ranges, each suffixed with k or m for kilobytes
+// or megabytes, into ascending order.
+func parseRanges(arg string) ([]byteRange, error) {
+	var ranges []byteRange
+	for _, r := range strings.Split(arg, ",") {
+		off, length, ok := strings.Cut(r, ":")
+		if !ok {
+			return nil, fmt.Errorf("'%s' is not offset:length", r)
+		}
+		o, err := parseSize(off)
+		if err != nil {
+			return nil, err
+		}
+		l, err := parseSize(length)
+		if err != nil {
+			return nil, err
+		}
+		if o < 0 || l <= 0 {
+			return nil, fmt.Errorf("'%s' is not a valid range", r)
+		}
+		ranges = append(ranges, byteRange{offset: o, length: l})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].offset < ranges[j].offset })
+	return ranges, nil
+}
+
+// pump copies one direction of the stream in the pattern set by the size, count, delay, timeout and bandwidth
+// flags and the link impairments, keeping the statistics for its summary.
+type pump struct {
+	in        io.Reader
+	out       io.Writer
+	size      int
+	count     int
+	delay     time.Duration
+	timeout   time.Duration
+	bandwidth int
+	impair    impairment
+	rng       *rand.Rand
+	faults    *faults
+	csvLog    *stats.IntervalLog
+	engine    string
+	// stopped reports whether the endpoints were closed on purpose, so errors from them mark the end of the stream.
+	stopped func() bool
+	// closeAll closes both endpoints after an emulated connection reset.
+	closeAll func()
+
+	bytesIn      int
+	bytesOut     int
+	readOps      int
+	writeOps     int
+	readTime     time.Duration
+	writeTime    time.Duration
+	delayTime    time.Duration
+	throttleTime time.Duration
+	firstByte    time.Time
+	lastByte     time.Time
+	reset        bool
+	err          error
+	writeErr     error
+	writeFailed  int32
+	engineUsed   string
+	fallbacks    []string
+}
+
+// run copies until EOF, an error, Count iterations or the timeout, whichever comes first. With link latency the
+// writes happen on a separate goroutine so that reading carries on while chunks are in flight.
+func (p *pump) run(start time.Time) {
+	if p.engine != "rw" && p.zeroCopy(start) {
+		return
+	}
+	var queue chan inFlight
+	var drained chan struct{}
+	if p.impair.latency > 0 || p.impair.jitter > 0 {
+		queue = make(chan inFlight, inFlightChunks)
+		drained = make(chan struct{})
+		go func() {
+			defer close(drained)
+			p.drain(queue, start)
+		}()
+	}
+	buf := make([]byte, p.size)
+	var eof bool
+	x := 0
+	for atomic.LoadInt32(&p.writeFailed) == 0 {
+		if time.Since(start) >= p.timeout && p.timeout != 0 {
+			break
+		}
+		opStart := time.Now()
+		b, err := p.in.Read(buf)
+		opEnd := time.Now()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		} else if err != nil && (atomic.LoadInt32(&p.writeFailed) == 1 || (p.stopped != nil && p.stopped())) {
+			break
+		}
+		p.readTime += opEnd.Sub(opStart)
+		p.bytesIn += b
+		p.readOps += 1
+		if b > 0 && p.firstByte.IsZero() {
+			p.firstByte = opEnd
+		}
+		if err != nil && err != io.EOF {
+			p.csvLog.Record(opEnd, 0, opEnd.Sub(opStart), err)
+			p.err = fmt.Errorf("Error encountered while reading: %v", err)
+			break
+		} else if err == io.EOF {
+			eof = true
+		}
+		chunks := [][]byte{buf[:b]}
+		if p.faults != nil && b > 0 {
+			var truncated bool
+			chunks, truncated = p.faults.apply(buf[:b])
+			eof = eof || truncated
+		}
+		if b == 0 {
+			p.csvLog.Record(opEnd, 0, opEnd.Sub(opStart), nil)
+		} else if !p.send(queue, chunks, opStart, opEnd, start) {
+			break
+		}
+		if eof {
+			break
+		}
+		if p.count == 0 {
+			continue
+		}
+		x += 1
+		if x == p.count {
+			break
+		}
+		delayStart := time.Now()
+		time.Sleep(p.delay)
+		p.delayTime += time.Since(delayStart)
+	}
+	if p.faults != nil && atomic.LoadInt32(&p.writeFailed) == 0 {
+		now := time.Now()
+		p.send(queue, p.faults.flush(), now, now, start)
+	}
+	if queue != nil {
+		close(queue)
+		<-drained
+	}
+}
+
+// send hands chunks to the link queue when there is one, or writes them straight away.
+func (p *pump) send(queue chan inFlight, chunks [][]byte, itrStart, readAt, start time.Time) bool {
+	for _, c := range chunks {
+		if len(c) == 0 {
+			continue
+		} else if queue != nil {
+			queue <- inFlight{data: append([]byte(nil), c...), readAt: readAt, itrTime: itrStart}
+		} else if !p.deliver(c, start, itrStart) {
+			return false
+		}
+	}
+	return true
+}
+
+// drain delivers chunks from queue once the link latency has passed, keeping them in order. Once delivery fails the
+// rest of the queue is discarded so that reading never blocks on it.
+func (p *pump) drain(queue chan inFlight, start time.Time) {
+	var due time.Time
+	for c := range queue {
+		if atomic.LoadInt32(&p.writeFailed) == 1 {
+			continue
+		}
+		d := p.impair.latency
+		if p.impair.jitter > 0 {
+			d += time.Duration((p.rng.Float64()*2 - 1) * float64(p.impair.jitter))
+		}
+		if d < 0 {
+			d = 0
+		}
+		if c.readAt.Add(d).After(due) {
+			due = c.readAt.Add(d)
+		}
+		time.Sleep(time.Until(due))
+		p.deliver(c.data, start, c.itrTime)
+	}
+}
+
+// deliver writes one chunk to the output, split into fragments if asked, then applies the bandwidth cap and any
+// emulated reset. A write that would cross the reset threshold stops at it, so a reset happens after exactly that
+// many bytes. It returns false once the pump should stop.
+func (p *pump) deliver(chunk []byte, start, itrStart time.Time) bool {
+	var written int
+	var opEnd time.Time
+	var rolled bool
+	for len(chunk) > 0 {
+		n := len(chunk)
+		if p.impair.fragment > 0 && n > p.impair.fragment {
+			n = p.impair.fragment
+		}
+		if p.impair.fragment > 0 {
+			n = 1 + p.rng.Intn(n)
+		}
+		if p.impair.resetAfter > 0 && p.bytesOut < p.impair.resetAfter && n > p.impair.resetAfter-p.bytesOut {
+			n = p.impair.resetAfter - p.bytesOut
+		}
+		opStart := time.Now()
+		b, err := p.out.Write(chunk[:n])
+		opEnd = time.Now()
+		p.writeTime += opEnd.Sub(opStart)
+		p.bytesOut += b
+		p.writeOps += 1
+		written += b
+		if b > 0 {
+			p.lastByte = opEnd
+		}
+		if err != nil {
+			p.csvLog.Record(opEnd, written, opEnd.Sub(itrStart), err)
+			if p.stopped == nil || !p.stopped() {
+				p.writeErr = fmt.Errorf("Error encountered while writing: %v", err)
+			}
+			atomic.StoreInt32(&p.writeFailed, 1)
+			return false
+		}
+		chunk = chunk[n:]
+		if p.impair.resetAfter > 0 && p.bytesOut == p.impair.resetAfter && len(chunk) > 0 {
+			// The threshold fell inside the chunk, so this is the chunk's one chance to reset.
+			rolled = true
+			if p.maybeReset() {
+				p.csvLog.Record(opEnd, written, opEnd.Sub(itrStart), nil)
+				return false
+			}
+		}
+	}
+	p.csvLog.Record(opEnd, written, opEnd.Sub(itrStart), nil)
+	if !rolled && p.maybeReset() {
+		return false
+	}
+	p.throttle(start)
+	return true
+}
+
+// maybeReset resets the connections, with the -rp probability, once -rst bytes have been written. It reports
+// whether it did.
+func (p *pump) maybeReset() bool {
+	if p.impair.resetAfter == 0 || p.bytesOut < p.impair.resetAfter || p.rng.Float64() >= p.impair.resetProb {
+		return false
+	}
+	p.reset = true
+	atomic.StoreInt32(&p.writeFailed, 1)
+	p.closeAll()
+	return true
+}
+
+// zeroCopy copies with the first engine of p.engine's candidates that works, returning false without having
+// moved any data if none does, so the read/write loop takes over.
+func (p *pump) zeroCopy(start time.Time) bool {
+	for _, name := range engineCandidates(p.engine, p.in, p.out) {
+		e, err := newEngine(name, p.in, p.out)
+		if err == nil {
+			err = p.runEngine(e, start)
+			e.close()
+		}
+		if err == nil {
+			p.engineUsed = name
+			return true
+		}
+		p.fallbacks = append(p.fallbacks, fmt.Sprintf("%s: %v", name, err))
+	}
+	p.engineUsed = "rw"
+	return false
+}
+
+// runEngine copies with e under the same count, delay, timeout and bandwidth controls as run. A move counts as
+// both a read and a write. It returns an error only if e turned out to be unsupported on its first move, by which
+// point whatever that move took from the input has been written out, so the read/write loop can carry on.
+func (p *pump) runEngine(e *copyEngine, start time.Time) error {
+	for x := 0; p.count == 0 || x < p.count; x += 1 {
+		if time.Since(start) >= p.timeout && p.timeout != 0 {
+			break
+		}
+		opStart := time.Now()
+		n, err := e.move(p.size)
+		opEnd := time.Now()
+		fallback := x == 0 && unsupported(err)
+		if fallback && n == 0 {
+			return err
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		p.readTime += opEnd.Sub(opStart)
+		p.writeTime += opEnd.Sub(opStart)
+		p.bytesIn += n
+		p.bytesOut += n
+		p.readOps += 1
+		p.writeOps += 1
+		if n > 0 {
+			if p.firstByte.IsZero() {
+				p.firstByte = opEnd
+			}
+			p.lastByte = opEnd
+		}
+		if fallback {
+			p.csvLog.Record(opEnd, n, opEnd.Sub(opStart), nil)
+			return err
+		}
+		if err == io.EOF {
+			p.csvLog.Record(opEnd, n, opEnd.Sub(opStart), nil)
+			break
+		} else if err != nil {
+			p.csvLog.Record(opEnd, n, opEnd.Sub(opStart), err)
+			if p.stopped == nil || !p.stopped() {
+				p.err = fmt.Errorf("Error encountered while copying with %s: %v", e.name, err)
+			}
+			break
+		}
+		p.csvLog.Record(opEnd, n, opEnd.Sub(opStart), nil)
+		p.throttle(start)
+		delayStart := time.Now()
+		time.Sleep(p.delay)
+		p.delayTime += time.Since(delayStart)
+	}
+	return nil
+}
+
+// throttle sleeps until the bytes written so far fit within the bandwidth cap.
+func (p *pump) throttle(start time.Time) {
+	if p.bandwidth > 0 {
+		due := start.Add(time.Duration(float64(p.bytesOut) / float64(p.bandwidth) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
+			p.throttleTime += wait
+		}
+	}
+}
+
+// resetConn closes rw, making a TCP connection send a RST rather than a FIN.
+func resetConn(rw io.ReadWriteCloser) {
+	if tc, ok := rw.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	if g, ok := rw.(*endpoint.ConnGroup); ok {
+		for _, c := range g.Conns() {
+			resetConn(c)
+		}
+	}
+	rw.Close()
+}
+
+// report prints the byte counts, timing and throughput of the pump.
+func (p *pump) report(out io.Writer, start time.Time, wall time.Duration, units string) {
+	fmt.Fprintf(out, "Read %d bytes (%s) and wrote %d bytes (%s) in %s\n", p.bytesIn, stats.FormatBytes(float64(p.bytesIn), units),
+		p.bytesOut, stats.FormatBytes(float64(p.bytesOut), units), wall.String())
+	fmt.Fprintf(out, "Active reading %s, active writing %s, delay %s, throttled %s\n", p.readTime.String(),
+		p.writeTime.String(), p.delayTime.String(), p.throttleTime.String())
+	fmt.Fprintf(out, "First byte read after %s, last byte written after %s\n", stats.SinceStart(start, p.firstByte),
+		stats.SinceStart(start, p.lastByte))
+	if p.reset {
+		fmt.Fprintf(out, "Reset the connection after writing %d bytes\n", p.bytesOut)
+	}
+	fmt.Fprintf(out, "%s; %s\n", stats.FormatAverage(p.bytesIn, p.readOps, units, "read"),
+		stats.FormatAverage(p.bytesOut, p.writeOps, units, "write"))
+	fmt.Fprintf(out, "Read throughput: %s\n", stats.FormatRate(p.bytesIn, p.readOps, wall, units, "read"))
+	fmt.Fprintf(out, "Write throughput: %s\n", stats.FormatRate(p.bytesOut, p.writeOps, wall, units, "write"))
+	if p.engine != "rw" {
+		fmt.Fprintf(out, "Copy engine: %s\n", p.engineUsed)
+		for _, f := range p.fallbacks {
+			fmt.Fprintf(out, "Fell back from %s\n", f)
+		}
+	}
 }
 
 func main() {
-	var inFile, outFile string
+	var inFiles []string
+	var inputMode = "cat"
+	var outFiles []string
 	var size = 256 * 1024
 	var count int
 	var delay, openDelay, startDelay, timeout time.Duration
 	var log = io.Discard
+	var units = "iec"
+	var resourceUsage bool
+	var split endpoint.Splitter
+	var waitFor string
+	var waitTimeout time.Duration
+	var teePolicy = "block"
+	var teeLimit = 1024 * 1024
+	var bandwidth, reverseBandwidth int
+	var relay bool
+	var reverseDelay time.Duration
+	var halfClose = "half"
+	var impair = impairment{resetProb: 1}
+	var engine = "rw"
+	var seed = time.Now().UnixNano()
+	var faultConfig = faults{truncateAt: -1}
+	var faultLog io.Writer
+	var accepts = 1
+	var sockOpts endpoint.Options
+	var mkFIFO, rmFIFO bool
+	var pipeQuery bool
+	var pipeSize int
+	var csvFile io.Writer
+	var csvInterval = time.Second
 	var rc int
 
 	var skip = true
@@ -61,11 +1316,11 @@ func main() {
 		case "-i":
 			arg += 1
 			skip = true
-			inFile = os.Args[arg]
+			inFiles = append(inFiles, os.Args[arg])
 		case "-o":
 			arg += 1
 			skip = true
-			outFile = os.Args[arg]
+			outFiles = append(outFiles, os.Args[arg])
 		case "-l":
 			arg += 1
 			skip = true
@@ -77,22 +1332,11 @@ func main() {
 		case "-s":
 			arg += 1
 			skip = true
-			var mult = 1
-			var s string
-			if strings.HasSuffix(os.Args[arg], "k") {
-				mult = 1024
-				s = strings.TrimSuffix(os.Args[arg], "k")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = 1024 * 1024
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else {
-				s = os.Args[arg]
-			}
-			sz, err := strconv.ParseInt(s, 10, 32)
+			sz, err := parseSize(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for size '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for size '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			size = int(sz) * mult
+			size = sz
 		case "-c":
 			arg += 1
 			skip = true
@@ -105,91 +1349,82 @@ func main() {
 		case "-d":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			delay = time.Duration(t) * mult
+			delay = t
 		case "-od":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			openDelay = time.Duration(t) * mult
+			openDelay = t
 		case "-t":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
+			t, err := parseDuration(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			timeout = t
+		case "-ss":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for split size '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Size = sz
+		case "-sc":
+			arg += 1
+			skip = true
+			c, err := strconv.ParseInt(os.Args[arg], 10, 32)
+			if err != nil || c <= 0 {
+				handleError(fmt.Errorf("invalid argument for split count '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Count = int(c)
+		case "-st":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for split time '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Period = t
+		case "-sk":
+			arg += 1
+			skip = true
+			k, err := strconv.ParseInt(os.Args[arg], 10, 32)
+			if err != nil || k <= 0 {
+				handleError(fmt.Errorf("invalid argument for split keep '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Keep = int(k)
+		case "-wf":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "exists" && os.Args[arg] != "nonempty" && os.Args[arg] != "closed" {
+				handleError(fmt.Errorf("invalid argument for wait for '%s'", os.Args[arg]), log, syntaxError)
 			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			waitFor = os.Args[arg]
+		case "-wt":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for wait timeout '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			timeout = time.Duration(t) * mult
+			waitTimeout = t
 		case "-sd":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			startDelay = time.Duration(t) * mult
+			startDelay = t
 		case "-rc":
 			arg += 1
 			skip = true
@@ -198,6 +1433,248 @@ func main() {
 				handleError(fmt.Errorf("Invalid return code '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
 			rc = returnCode
+		case "-im":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "cat" && os.Args[arg] != "rr" && os.Args[arg] != "any" {
+				handleError(fmt.Errorf("invalid argument for input mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+			inputMode = os.Args[arg]
+		case "-tp":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "block" && os.Args[arg] != "buffer" && os.Args[arg] != "drop" {
+				handleError(fmt.Errorf("invalid argument for tee policy '%s'", os.Args[arg]), log, syntaxError)
+			}
+			teePolicy = os.Args[arg]
+		case "-tb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for tee buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			teeLimit = sz
+		case "-ce":
+			arg += 1
+			skip = true
+			switch os.Args[arg] {
+			case "auto", "rw", "splice", "sendfile", "cfr":
+				engine = os.Args[arg]
+			default:
+				handleError(fmt.Errorf("invalid argument for copy engine '%s'", os.Args[arg]), log, syntaxError)
+			}
+		case "-bw":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz < 0 {
+				handleError(fmt.Errorf("invalid argument for bandwidth '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			bandwidth = sz
+		case "-rl":
+			relay = true
+		case "-rd":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("invalid argument for reverse delay '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			reverseDelay = t
+		case "-rbw":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz < 0 {
+				handleError(fmt.Errorf("invalid argument for reverse bandwidth '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			reverseBandwidth = sz
+		case "-hc":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "half" && os.Args[arg] != "full" {
+				handleError(fmt.Errorf("invalid argument for half close '%s'", os.Args[arg]), log, syntaxError)
+			}
+			halfClose = os.Args[arg]
+		case "-lat":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for latency '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			impair.latency = t
+		case "-jit":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for jitter '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			impair.jitter = t
+		case "-fr":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for fragment '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			impair.fragment = sz
+		case "-rst":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for reset '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			impair.resetAfter = sz
+		case "-rp":
+			arg += 1
+			skip = true
+			p, err := strconv.ParseFloat(os.Args[arg], 64)
+			if err != nil || p < 0 || p > 1 {
+				handleError(fmt.Errorf("invalid argument for reset probability '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			impair.resetProb = p
+		case "-bf", "-dup", "-ro", "-gb":
+			flag := os.Args[arg]
+			arg += 1
+			skip = true
+			p, err := strconv.ParseFloat(os.Args[arg], 64)
+			if err != nil || p < 0 || p > 1 {
+				handleError(fmt.Errorf("invalid argument for %s '%s': %v", flag, os.Args[arg], err), log, syntaxError)
+			}
+			switch flag {
+			case "-bf":
+				faultConfig.bitFlipRate = p
+			case "-dup":
+				faultConfig.dupProb = p
+			case "-ro":
+				faultConfig.reorderProb = p
+			case "-gb":
+				faultConfig.garbageProb = p
+			}
+		case "-drop":
+			arg += 1
+			skip = true
+			ranges, err := parseRanges(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("invalid argument for drop '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			faultConfig.drops = ranges
+		case "-tr":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz < 0 {
+				handleError(fmt.Errorf("invalid argument for truncate '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			faultConfig.truncateAt = sz
+		case "-fl":
+			arg += 1
+			skip = true
+			f, err := os.Create(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("could not open fault log: %v", err), log, syntaxError)
+			}
+			faultLog = f
+		case "-seed":
+			arg += 1
+			skip = true
+			n, err := strconv.ParseInt(os.Args[arg], 10, 64)
+			if err != nil {
+				handleError(fmt.Errorf("invalid argument for seed '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			seed = n
+		case "-n":
+			arg += 1
+			skip = true
+			n, err := strconv.Atoi(os.Args[arg])
+			if err != nil || n < 1 {
+				handleError(fmt.Errorf("invalid argument for connections '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			accepts = n
+		case "-nd":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "on" && os.Args[arg] != "off" {
+				handleError(fmt.Errorf("invalid argument for no delay '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.NoDelay = os.Args[arg]
+		case "-sb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for send buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.SndBuf = sz
+		case "-rb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for receive buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.RcvBuf = sz
+		case "-pm":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "raw" && os.Args[arg] != "cooked" {
+				handleError(fmt.Errorf("invalid argument for pty mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyMode = os.Args[arg]
+		case "-pw":
+			arg += 1
+			skip = true
+			cols, rows, _ := strings.Cut(os.Args[arg], "x")
+			c, err := strconv.Atoi(cols)
+			r, err2 := strconv.Atoi(rows)
+			if err != nil || err2 != nil || c <= 0 || r <= 0 || c > 65535 || r > 65535 {
+				handleError(fmt.Errorf("invalid argument for pty window '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyCols, sockOpts.PtyRows = c, r
+		case "-mf":
+			mkFIFO = true
+		case "-rf":
+			rmFIFO = true
+		case "-pq":
+			pipeQuery = true
+		case "-ps":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for pipe size '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			pipeQuery = true
+			pipeSize = sz
+		case "-csv":
+			arg += 1
+			skip = true
+			f, err := os.Create(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("could not open CSV log: %v", err), log, syntaxError)
+			}
+			csvFile = f
+		case "-ci":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for CSV interval '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			csvInterval = t
+		case "-ru":
+			resourceUsage = true
+		case "-u":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "iec" && os.Args[arg] != "si" {
+				handleError(fmt.Errorf("invalid argument for units '%s'", os.Args[arg]), log, syntaxError)
+			}
+			units = os.Args[arg]
 		case "-h":
 			usage(log)
 		default:
@@ -205,82 +1682,273 @@ func main() {
 		}
 	}
 
-	buf := make([]byte, 0, size)
-	var bytesIn, bytesOut int
-	var output = os.Stdout
-	var input = os.Stdin
+	var output io.ReadWriteCloser = os.Stdout
+	var input io.ReadWriteCloser = os.Stdin
+	var inputName, outputName = "stdin", "stdout"
+	var inFlag, outFlag = os.O_RDONLY | os.O_CREATE, os.O_WRONLY | os.O_CREATE
+	if relay {
+		if len(inFiles) == 0 && len(outFiles) == 0 {
+			handleError(fmt.Errorf("relay mode needs -i or -o"), log, syntaxError)
+		} else if len(inFiles) > 1 || len(outFiles) > 1 {
+			handleError(fmt.Errorf("relay mode takes a single -i and -o"), log, syntaxError)
+		} else if split.Enabled() {
+			handleError(fmt.Errorf("relay mode cannot split output"), log, syntaxError)
+		}
+		input, output = stdio{}, stdio{}
+		inputName, outputName = "stdio", "stdio"
+		inFlag, outFlag = os.O_RDWR, os.O_RDWR
+	}
+	var inputs, outputs []io.ReadWriteCloser
+	var splits []*endpoint.Splitter
+	var inOpenTimes, outOpenTimes, waitTimes []time.Duration
+	var fdTypes = map[string]string{}
 	var err error
-	if inFile != "" || outFile != "" {
+	if len(inFiles) > 0 || len(outFiles) > 0 {
 		time.Sleep(openDelay)
-		if outFile != "" {
-			output, err = os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE, 0755)
+		for _, f := range append(append([]string(nil), inFiles...), outFiles...) {
+			if f == "-" {
+				continue
+			}
+			if rmFIFO && !endpoint.IsURL(f) {
+				endpoint.RemoveFIFOAtExit(f)
+			}
+			if mkFIFO && !endpoint.IsURL(f) {
+				if err = endpoint.MakeFIFO(f); err != nil {
+					handleError(err, log, runtimeError)
+				}
+			}
+		}
+		for _, f := range outFiles {
+			var o io.ReadWriteCloser = os.Stdout
+			if strings.HasPrefix(f, "fd://") {
+				fdTypes[f] = endpoint.FdType(f)
+			}
+			openStart := time.Now()
+			if split.Enabled() && f != "-" && !endpoint.IsURL(f) {
+				var s *endpoint.Splitter
+				s, err = split.Open(f)
+				o = s
+				if err == nil {
+					splits = append(splits, s)
+				}
+			} else if f != "-" {
+				o, err = endpoint.Open(f, outFlag, accepts, sockOpts)
+			}
+			outOpenTimes = append(outOpenTimes, time.Since(openStart))
 			if err != nil {
 				handleError(err, log, runtimeError)
 			}
+			if t, ok := o.(*endpoint.Pty); ok && !t.HasChild() {
+				fmt.Fprintf(log, "Opened pty %s\n", t.SlavePath())
+			}
+			outputs = append(outputs, o)
+		}
+		if len(outputs) == 1 {
+			output, outputName = outputs[0], outFiles[0]
+		} else if len(outputs) > 1 {
+			output, outputName = newTee(outputs, outFiles, teePolicy, teeLimit), strings.Join(outFiles, ", ")
 		}
-		if inFile != "" {
-			input, err = os.OpenFile(inFile, os.O_RDONLY|os.O_CREATE, 0755)
+		for _, f := range inFiles {
+			var i io.ReadWriteCloser = os.Stdin
+			var waitTime time.Duration
+			if waitFor != "" && f != "-" && !endpoint.IsURL(f) {
+				waitStart := time.Now()
+				err = endpoint.WaitForFile(f, waitFor, waitTimeout)
+				waitTime = time.Since(waitStart)
+				if err != nil {
+					handleError(err, log, runtimeError)
+				}
+			}
+			waitTimes = append(waitTimes, waitTime)
+			if strings.HasPrefix(f, "fd://") {
+				fdTypes[f] = endpoint.FdType(f)
+			}
+			openStart := time.Now()
+			if f != "-" {
+				i, err = endpoint.Open(f, inFlag, accepts, sockOpts)
+			}
+			inOpenTimes = append(inOpenTimes, time.Since(openStart))
 			if err != nil {
 				handleError(err, log, runtimeError)
 			}
+			if t, ok := i.(*endpoint.Pty); ok && !t.HasChild() {
+				fmt.Fprintf(log, "Opened pty %s\n", t.SlavePath())
+			}
+			inputs = append(inputs, i)
+		}
+		if len(inputs) == 1 {
+			input, inputName = inputs[0], inFiles[0]
+		} else if len(inputs) > 1 {
+			input, inputName = newMerge(inputs, inFiles, inputMode, size), strings.Join(inFiles, ", ")
+		}
+	}
+	if split.Enabled() && len(splits) == 0 {
+		handleError(fmt.Errorf("splitting output needs a file path for -o"), log, syntaxError)
+	}
+	var pipes []string
+	if pipeQuery {
+		ends, names := append(append([]io.ReadWriteCloser(nil), inputs...), outputs...), append(append([]string(nil), inFiles...), outFiles...)
+		if len(inputs) == 0 {
+			ends, names = append([]io.ReadWriteCloser{input}, ends...), append([]string{inputName}, names...)
+		}
+		if len(outputs) == 0 {
+			ends, names = append(ends, output), append(names, outputName)
+		}
+		for i, o := range ends {
+			n, err := endpoint.PipeCapacity(o, names[i], pipeSize)
+			if err != nil && pipeSize != 0 {
+				handleError(err, log, runtimeError)
+			} else if err != nil {
+				pipes = append(pipes, err.Error())
+			} else {
+				pipes = append(pipes, fmt.Sprintf("Pipe capacity of %s is %d bytes", names[i], n))
+			}
 		}
 	}
 	time.Sleep(startDelay)
+	var usageStart stats.Usage
+	if resourceUsage {
+		usageStart = stats.SampleUsage()
+	}
 	start := time.Now()
-	var runtime time.Duration
-	var eof bool
-	x := 0
-	for {
-		runtime = time.Since(start)
-		if runtime >= timeout && timeout != 0 {
-			break
+	if d, ok := input.(interface{ SetReadDeadline(time.Time) error }); ok && timeout != 0 {
+		// Datagram sockets never reach EOF, so a blocked read must not outlast the timeout.
+		d.SetReadDeadline(start.Add(timeout))
+	}
+	var csvLog *stats.IntervalLog
+	if csvFile != nil {
+		csvLog = stats.NewIntervalLog(csvFile, csvInterval, start)
+	}
+	if faultConfig.enabled() || impair.latency > 0 || impair.jitter > 0 || impair.fragment > 0 || impair.resetAfter > 0 {
+		if engine != "rw" && engine != "auto" {
+			handleError(fmt.Errorf("faults and impairments need the rw copy engine"), log, syntaxError)
 		}
-		b, err := input.Read(buf)
-		bytesIn += b
-		if err != nil && err != io.EOF {
-			fmt.Fprintf(log, "Error encountered while reading: %v\n")
-			rc = runtimeError
-			break
-		} else if err == io.EOF {
-			eof = true
-			b, err = output.Write(buf[:b])
-		} else {
-			b, err = output.Write(buf)
+		engine = "rw"
+	}
+	forward := &pump{in: input, out: output, size: size, count: count, delay: delay, timeout: timeout,
+		bandwidth: bandwidth, impair: impair, rng: rand.New(rand.NewSource(seed)), csvLog: csvLog, engine: engine}
+	closeAll := func() {
+		resetConn(input)
+		resetConn(output)
+	}
+	forward.closeAll = closeAll
+	if faultConfig.enabled() {
+		if faultLog == nil {
+			faultLog = log
 		}
-		bytesOut += b
-		if err != nil {
-			fmt.Fprintf(log, "Error encountered while writing: %v\n")
-			rc = runtimeError
-			break
+		forward.faults = newFaults(faultConfig, seed+2, faultLog)
+	}
+	var reverse *pump
+	if relay {
+		if d, ok := output.(interface{ SetReadDeadline(time.Time) error }); ok && timeout != 0 {
+			d.SetReadDeadline(start.Add(timeout))
 		}
-		if eof {
-			break
+		reverse = &pump{in: output, out: input, size: size, count: count, delay: reverseDelay, timeout: timeout,
+			bandwidth: reverseBandwidth, impair: impair, rng: rand.New(rand.NewSource(seed + 1)), csvLog: csvLog,
+			engine: engine}
+		var closing int32
+		stopped := func() bool { return atomic.LoadInt32(&closing) == 1 }
+		forward.stopped, reverse.stopped = stopped, stopped
+		forward.closeAll = func() {
+			if atomic.CompareAndSwapInt32(&closing, 0, 1) {
+				closeAll()
+			}
+		}
+		reverse.closeAll = forward.closeAll
+		var wg sync.WaitGroup
+		relayDirection := func(p *pump, dst io.ReadWriteCloser) {
+			defer wg.Done()
+			p.run(start)
+			if halfClose == "full" || p.err != nil || p.writeErr != nil {
+				if atomic.CompareAndSwapInt32(&closing, 0, 1) {
+					input.Close()
+					output.Close()
+				}
+			} else if !stopped() {
+				closeWrite(dst)
+			}
+		}
+		wg.Add(2)
+		go relayDirection(forward, output)
+		go relayDirection(reverse, input)
+		wg.Wait()
+	} else {
+		forward.run(start)
+	}
+	if t, ok := output.(*tee); ok {
+		t.wait()
+	}
+	end := time.Now()
+	csvLog.Flush(end)
+	for _, rw := range append(append([]io.ReadWriteCloser(nil), inputs...), outputs...) {
+		if w, ok := rw.(endpoint.Waiter); ok {
+			w.Wait()
 		}
-		if count == 0 {
+	}
+	var usageEnd stats.Usage
+	if resourceUsage {
+		usageEnd = stats.SampleUsage()
+	}
+	wall := end.Sub(start)
+	if relay {
+		fmt.Fprintf(log, "Forward, %s to %s:\n", inputName, outputName)
+	}
+	forward.report(log, start, wall, units)
+	if relay {
+		fmt.Fprintf(log, "Reverse, %s to %s:\n", outputName, inputName)
+		reverse.report(log, start, wall, units)
+	}
+	for _, p := range []*pump{forward, reverse} {
+		if p == nil {
 			continue
 		}
-		x += 1
-		if x == count {
-			break
+		for _, err := range []error{p.err, p.writeErr} {
+			if err != nil {
+				fmt.Fprintf(log, "%v\n", err)
+				rc = runtimeError
+			}
 		}
-		time.Sleep(delay)
 	}
-	var bytesRead string
-	if bytesIn > 1024*1024*10 {
-		bytesRead = fmt.Sprintf("%d megabytes", bytesIn/1024/1024)
-	} else if bytesIn > 1024*10 {
-		bytesRead = fmt.Sprintf("%d kilobytes", bytesIn/1024)
-	} else {
-		bytesRead = fmt.Sprintf("%d bytes", bytesIn)
+	if m, ok := input.(*merge); ok {
+		m.report(log, start, units)
 	}
-	var bytesWritten string
-	if bytesOut > 1024*1024*10 {
-		bytesWritten = fmt.Sprintf("%d megabytes", bytesOut/1024/1024)
-	} else if bytesOut > 1024*10 {
-		bytesWritten = fmt.Sprintf("%d kilobytes", bytesOut/1024)
-	} else {
-		bytesWritten = fmt.Sprintf("%d bytes", bytesOut)
+	if t, ok := output.(*tee); ok {
+		t.report(log, units)
 	}
-	fmt.Fprintf(log, "Read %s and wrote %s in %s\n", bytesRead, bytesWritten, runtime.String())
-	os.Exit(rc)
+	for _, s := range splits {
+		s.Report(log)
+	}
+	for _, rw := range append(append([]io.ReadWriteCloser(nil), inputs...), outputs...) {
+		if w, ok := rw.(endpoint.Waiter); ok {
+			w.Report(log)
+		}
+	}
+	if forward.faults != nil {
+		forward.faults.report(log)
+	}
+	if impair.jitter > 0 || impair.fragment > 0 || impair.resetAfter > 0 || forward.faults != nil {
+		fmt.Fprintf(log, "Random seed %d\n", seed)
+	}
+	for i, f := range inFiles {
+		fmt.Fprintf(log, "Open of %s blocked for %s\n", f, inOpenTimes[i].String())
+		if kind, ok := fdTypes[f]; ok {
+			fmt.Fprintf(log, "%s is a %s\n", f, kind)
+		}
+		if waitFor != "" && f != "-" && !endpoint.IsURL(f) {
+			fmt.Fprintf(log, "Waited %s for %s (%s)\n", waitTimes[i].String(), f, waitFor)
+		}
+	}
+	for i, f := range outFiles {
+		fmt.Fprintf(log, "Open of %s blocked for %s\n", f, outOpenTimes[i].String())
+		if kind, ok := fdTypes[f]; ok {
+			fmt.Fprintf(log, "%s is a %s\n", f, kind)
+		}
+	}
+	for _, p := range pipes {
+		fmt.Fprintf(log, "%s\n", p)
+	}
+	if resourceUsage {
+		stats.ReportUsage(log, usageStart, usageEnd)
+	}
+	exit(rc)
 }
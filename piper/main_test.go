@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// applyAll feeds chunks through a fresh faults built from cfg with a fixed seed, returning each write and the
+// fault log without its header.
+func applyAll(cfg faults, chunks ...string) ([]string, []string) {
+	var log bytes.Buffer
+	f := newFaults(cfg, 1, &log)
+	var out []string
+	for _, c := range chunks {
+		writes, truncated := f.apply([]byte(c))
+		for _, w := range writes {
+			out = append(out, string(w))
+		}
+		if truncated {
+			break
+		}
+	}
+	for _, w := range f.flush() {
+		out = append(out, string(w))
+	}
+	rows := strings.Split(strings.TrimSpace(log.String()), "\n")
+	return out, rows[1:]
+}
+
+func TestFaultsApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		cfg    faults
+		chunks []string
+		out    []string
+		rows   []string
+	}{
+		{"none", faults{truncateAt: -1}, []string{"abcd", "efgh"}, []string{"abcd", "efgh"}, []string{}},
+		{"drop inside a chunk", faults{truncateAt: -1, drops: []byteRange{{2, 3}}}, []string{"abcdefgh"},
+			[]string{"abfgh"}, []string{"2,2,drop,3,"}},
+		{"drop across chunks", faults{truncateAt: -1, drops: []byteRange{{6, 4}}}, []string{"abcdefgh", "ijklmnop"},
+			[]string{"abcdef", "klmnop"}, []string{"6,6,drop,2,", "8,6,drop,2,"}},
+		{"two drops", faults{truncateAt: -1, drops: []byteRange{{0, 1}, {3, 1}}}, []string{"abcdef"},
+			[]string{"bcef"}, []string{"0,0,drop,1,", "3,2,drop,1,"}},
+		{"duplicate", faults{truncateAt: -1, dupProb: 1}, []string{"abcd", "ef"},
+			[]string{"abcd", "abcd", "ef", "ef"}, []string{"0,4,duplicate,4,", "4,10,duplicate,2,"}},
+		{"reorder", faults{truncateAt: -1, reorderProb: 1}, []string{"abcd", "efgh", "ijkl"},
+			[]string{"efgh", "abcd", "ijkl"}, []string{"0,4,reorder,4,written after input offset 4"}},
+		{"truncate", faults{truncateAt: 6}, []string{"abcd", "efgh", "ijkl"}, []string{"abcd", "ef"},
+			[]string{"6,6,truncate,0,"}},
+		{"truncate at a chunk boundary", faults{truncateAt: 4}, []string{"abcd", "efgh"}, []string{"abcd"},
+			[]string{"4,4,truncate,0,"}},
+		{"drop then truncate", faults{truncateAt: 6, drops: []byteRange{{1, 2}}}, []string{"abcdefgh"},
+			[]string{"adef"}, []string{"1,1,drop,2,", "6,4,truncate,0,"}},
+		{"garbage", faults{truncateAt: -1, garbageProb: 1}, []string{"abcd"},
+			[]string{"\x1dr\x95f", "abcd"}, []string{"0,0,garbage,4,"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, rows := applyAll(tt.cfg, tt.chunks...)
+			if !reflect.DeepEqual(out, tt.out) {
+				t.Errorf("output %q, want %q", out, tt.out)
+			}
+			if !reflect.DeepEqual(rows, tt.rows) {
+				t.Errorf("log %q, want %q", rows, tt.rows)
+			}
+		})
+	}
+}
+
+func TestFaultsFlipBits(t *testing.T) {
+	in := []byte("abcdefghijklmnop")
+	out, rows := applyAll(faults{truncateAt: -1, bitFlipRate: 1}, string(in[:10]), string(in[10:]))
+	got := []byte(strings.Join(out, ""))
+	if len(got) != len(in) || len(rows) != len(in) {
+		t.Fatalf("got %d bytes and %d log rows, want %d of each", len(got), len(rows), len(in))
+	}
+	for i := range in {
+		diff := got[i] ^ in[i]
+		if diff == 0 || diff&(diff-1) != 0 {
+			t.Errorf("byte %d changed from %#x to %#x, want exactly one bit flipped", i, in[i], got[i])
+		}
+		if prefix := fmt.Sprintf("%d,%d,bitflip,1,bit ", i, i); !strings.HasPrefix(rows[i], prefix) {
+			t.Errorf("log row %q, want prefix %q", rows[i], prefix)
+		}
+	}
+
+	// The same seed flips the same bits.
+	again, _ := applyAll(faults{truncateAt: -1, bitFlipRate: 1}, string(in))
+	if strings.Join(again, "") != string(got) {
+		t.Errorf("flips differ between runs with the same seed")
+	}
+
+	// At a low rate the flips are spread out but still roughly at that rate.
+	long := strings.Repeat("x", 100000)
+	_, rows = applyAll(faults{truncateAt: -1, bitFlipRate: 0.01}, long[:50000], long[50000:])
+	if len(rows) < 800 || len(rows) > 1200 {
+		t.Errorf("flipped %d bits in 100000 bytes at rate 0.01", len(rows))
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		arg    string
+		ranges []byteRange
+		ok     bool
+	}{
+		{"0:1", []byteRange{{0, 1}}, true},
+		{"10:5,0:2", []byteRange{{0, 2}, {10, 5}}, true},
+		{"1k:2k", []byteRange{{1024, 2048}}, true},
+		{"1m:1", []byteRange{{1024 * 1024, 1}}, true},
+		{"5", nil, false},
+		{"0:0", nil, false},
+		{"x:1", nil, false},
+		{"1:y", nil, false},
+		{"0:1,", nil, false},
+	}
+	for _, tt := range tests {
+		ranges, err := parseRanges(tt.arg)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseRanges(%q) error %v, want ok %v", tt.arg, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(ranges, tt.ranges) {
+			t.Errorf("parseRanges(%q) = %v, want %v", tt.arg, ranges, tt.ranges)
+		}
+	}
+}
+
+func TestCopyEngines(t *testing.T) {
+	tests := []struct {
+		engine   string
+		flag     int
+		fellBack bool
+	}{
+		{"splice", 0, false},
+		{"sendfile", 0, false},
+		{"auto", 0, false},
+		// None of the engines can append, so each hands over to the read/write loop without losing what it
+		// already took from the input.
+		{"splice", os.O_APPEND, true},
+		{"sendfile", os.O_APPEND, true},
+		{"cfr", os.O_APPEND, true},
+		{"auto", os.O_APPEND, true},
+	}
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, tt := range tests {
+		name := tt.engine
+		if tt.flag == os.O_APPEND {
+			name += " appending"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			inName, outName := filepath.Join(dir, "in"), filepath.Join(dir, "out")
+			if err := os.WriteFile(inName, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(outName, []byte("head"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			in, err := os.Open(inName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer in.Close()
+			out, err := os.OpenFile(outName, os.O_WRONLY|tt.flag, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+			if tt.flag == 0 {
+				out.Seek(4, 0)
+			}
+			p := &pump{in: in, out: out, size: 64 * 1024, engine: tt.engine}
+			p.run(time.Now())
+			if p.err != nil || p.writeErr != nil {
+				t.Fatalf("copy failed: %v, %v", p.err, p.writeErr)
+			}
+			if fellBack := p.engineUsed == "rw"; fellBack != tt.fellBack {
+				t.Errorf("used %s after falling back from %v", p.engineUsed, p.fallbacks)
+			}
+			if p.bytesIn != len(data) || p.bytesOut != len(data) {
+				t.Errorf("read %d and wrote %d bytes, want %d", p.bytesIn, p.bytesOut, len(data))
+			}
+			got, err := os.ReadFile(outName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, append([]byte("head"), data...)) {
+				t.Errorf("output is %d bytes and differs from the input", len(got))
+			}
+		})
+	}
+}
+
+// memOutput is a tee output that takes every write straight away.
+type memOutput struct {
+	bytes.Buffer
+}
+
+func (m *memOutput) Close() error {
+	return nil
+}
+
+// stuckOutput is a tee output whose writes never return until it is closed.
+type stuckOutput struct {
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (s *stuckOutput) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (s *stuckOutput) Write(p []byte) (int, error) {
+	<-s.closed
+	return 0, os.ErrClosed
+}
+
+func (s *stuckOutput) Close() error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestTeeDrop(t *testing.T) {
+	tests := []struct {
+		name    string
+		stuck   []bool
+		dropped []bool
+	}{
+		{"all healthy", []bool{false, false, false}, []bool{false, false, false}},
+		{"one stalled", []bool{false, true}, []bool{false, true}},
+		{"all stalled", []bool{true, true}, []bool{true, true}},
+	}
+	chunk := []byte("0123456789abcdef")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var outputs []io.ReadWriteCloser
+			var names []string
+			for i, stuck := range tt.stuck {
+				if stuck {
+					outputs = append(outputs, &stuckOutput{closed: make(chan struct{})})
+				} else {
+					outputs = append(outputs, &memOutput{})
+				}
+				names = append(names, fmt.Sprintf("out%d", i))
+			}
+			tee := newTee(outputs, names, "drop", 4*len(chunk))
+			tee.stall = 50 * time.Millisecond
+			var err error
+			for i := 0; i < 100 && err == nil; i += 1 {
+				_, err = tee.Write(chunk)
+			}
+			tee.Close()
+			allDropped := true
+			for i, b := range tee.branches {
+				if dropped := b.dropped != ""; dropped != tt.dropped[i] {
+					t.Errorf("%s dropped %v (%q), want %v", b.name, dropped, b.dropped, tt.dropped[i])
+				}
+				if m, ok := b.out.(*memOutput); ok && m.Len() != 100*len(chunk) {
+					t.Errorf("%s got %d bytes, want %d", b.name, m.Len(), 100*len(chunk))
+				}
+				allDropped = allDropped && tt.dropped[i]
+			}
+			if (err != nil) != allDropped {
+				t.Errorf("write error %v with every output dropped %v", err, allDropped)
+			}
+		})
+	}
+}
@@ -1,32 +1,95 @@
 package main
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"ioTools/internal/endpoint"
+	"ioTools/internal/stats"
 )
 
 const syntaxError = 3
 const runtimeError = 1
 
+// datagramHeader is the size of the sequence number and send time writer stamps on each UDP datagram.
+const datagramHeader = 16
+
+// exit runs the endpoint cleanups, since os.Exit skips deferred calls, and exits with rc.
+func exit(rc int) {
+	endpoint.RunAtExit()
+	os.Exit(rc)
+}
+
 func usage(out io.Writer) {
 	s := "Reads from a file or stdin in a pattern depending on several parameters.\n" +
 		"By default, reads from stdin in 256k blocks until EOF\n" +
-		" -f \tFile: file path to read from.\n" +
+		" -f \tFile: file path to read from,\n" +
+		"    \tor a socket: tcp://host:port, tcp-listen://[host]:port, unix://path, unix-listen://path,\n" +
+		"    \tunixpacket://path, unixpacket-listen://path, udp://host:port or udp-listen://[host]:port,\n" +
+		"    \tor fd://N for a descriptor inherited from the parent process, or exec://command args to run a command\n" +
+		"    \t(without a shell) and read its stdout.\n" +
+		"    \tpty:// opens a new pseudo-terminal, logging the path of its slave side for another process to use, and\n" +
+		"    \tpty://command args runs a command with the slave side as its terminal.\n" +
+		"    \tUnix socket paths starting with @ are abstract.\n" +
 		" -s \tSize: How many bytes to request on each read. Suffix with k or m for kilobytes or megabytes.\n" +
 		" -c \tCount: How many reads to try before quitting, unless EOF is reached first.\n" +
 		" -d \tDelay: How many seconds to delay between reads. Suffix with ms, m, or h.\n" +
 		" -od\tOpen Delay: How many seconds to delay before opening the file. Suffix with ms, m, or h. Ignored \n" +
 		"    \twithout -f.\n" +
+		" -wf\tWait For: Before opening -f, wait until it exists, is nonempty, or is closed by a process that was\n" +
+		"    \twriting it (closed). Uses inotify on the parent directory. Waits after Open Delay.\n" +
+		" -wt\tWait Timeout: How long -wf waits before failing. Suffix with ms, m, or h. Default is forever.\n" +
 		" -ed\tExit Delay: How many seconds to delay before exiting. Suffix with ms, m, or h.\n" +
 		" -t \tTimeout: How many seconds (not counting Start Delay) to run before quitting, unless Count is reached\n" +
 		"	 \tfirst. Suffix with ms, m, or h.\n" +
 		" -sd\tStart Delay: How many seconds to delay before the first read. Suffix with ms, m, or h.\n" +
 		" -l \tLog File: Log output to file instead of printing to stdout.\n" +
-		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0." +
+		" -fm\tFail Mode: Simulate a failing reader once -fb or -fo is reached. error stops with an I/O error,\n" +
+		"    \tkill sends SIGKILL to this process, exit exits at once without a summary or cleanup, close closes the\n" +
+		"    \tendpoint and carries on so later reads fail, and hang stops doing anything without exiting.\n" +
+		" -fb\tFail Bytes: Inject the -fm failure once this many bytes have been read. Suffix with k or m.\n" +
+		" -fo\tFail Ops: Inject the -fm failure once this many reads have been made.\n" +
+		" -tf\tTail Follow: Keep reading -f past EOF like tail -F, checking for more data this often. Reading\n" +
+		"    \tstarts over if the file is truncated and moves to the new file if another is created at the path.\n" +
+		"    \tStops after Count or Timeout. Suffix with ms, m, or h.\n" +
+		" -mm\tMemory Map: Read -f through mmap instead of read, copying Size bytes out of the mapping each\n" +
+		"    \titeration, with blocks in order (seq) or each once in a random order (rand). Page faults are reported.\n" +
+		" -sa\tStall After: Stop reading for Stall Length once this many bytes have been read. Suffix with k or m.\n" +
+		" -sl\tStall Length: How long -sa stops reading for. Suffix with ms, m, or h.\n" +
+		" -dg\tDelay Growth: Add this much to Delay after each read, so reads slow down steadily. Suffix with ms, m,\n" +
+		"    \tor h.\n" +
+		" -pe\tPause Every: Pause reading for Pause Length this often, like a garbage collector. Suffix with ms, m,\n" +
+		"    \tor h.\n" +
+		" -pl\tPause Length: How long each -pe pause lasts. Suffix with ms, m, or h.\n" +
+		" -bm\tBuffer Memory: Keep what is read in memory until this many bytes are held, then stop reading for\n" +
+		"    \tBuffer Drain while they are processed. Suffix with k or m.\n" +
+		" -bd\tBuffer Drain: How long processing a full -bm buffer takes. Suffix with ms, m, or h.\n" +
+		" -n \tConnections: How many connections a listening endpoint accepts. Reads drain each connection in turn. Default is 1.\n" +
+		" -nd\tNo Delay: Set TCP_NODELAY on or off for TCP connections. Defaults to the Go runtime's setting (on).\n" +
+		" -sb\tSend Buffer: SO_SNDBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -rb\tReceive Buffer: SO_RCVBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -pm\tPty Mode: Line discipline of pty:// endpoints, raw or cooked. Default is cooked.\n" +
+		" -pw\tPty Window: Window size of pty:// endpoints as COLSxROWS, such as 80x24.\n" +
+		" -mf\tMake FIFO: Create a named pipe at -f if nothing exists there.\n" +
+		" -rf\tRemove FIFO: Remove the named pipe at -f on exit. Anything other than a FIFO is left in place.\n" +
+		" -pq\tPipe Query: Report the kernel buffer size of stdin or the FIFO at -f in the summary.\n" +
+		" -ps\tPipe Size: Resize the kernel buffer of stdin or the FIFO at -f with F_SETPIPE_SZ. Suffix with k or m\n" +
+		"    \tfor kilobytes or megabytes. Implies -pq.\n" +
+		" -csv\tCSV Log: Write one row per interval (timestamp, bytes, ops, throughput, p99 latency of each\n" +
+		"    \tread, errors) to this file.\n" +
+		" -ci\tCSV Interval: How many seconds each CSV row covers. Suffix with ms, m, or h. Default is 1.\n" +
+		" -ru\tResource Usage: Include CPU time, context switches, page faults and kernel I/O counters\n" +
+		"    \t(/proc/self/io) in the summary.\n" +
+		" -u \tUnits: Unit prefixes used in the summary, either iec (KiB, MiB, ...) or si (kB, MB, ...). Default is iec.\n" +
+		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0.\n" +
 		" -h \tHelp: Prints this text\n" +
 		"Returns 0 on success, 1 if a runtime error is encountered, 3 if bad arguments are passed.\n"
 	fmt.Fprintf(out, s)
@@ -39,7 +102,324 @@ func handleError(err error, out io.Writer, rc int) {
 	} else {
 		fmt.Fprintf(out, "%v\n", err)
 	}
-	os.Exit(rc)
+	exit(rc)
+}
+
+// parseSize parses a number of bytes, suffixed with k or m for kilobytes or megabytes.
+func parseSize(arg string) (int, error) {
+	var mult = 1
+	var s string
+	if strings.HasSuffix(arg, "k") {
+		mult = 1024
+		s = strings.TrimSuffix(arg, "k")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = 1024 * 1024
+		s = strings.TrimSuffix(arg, "m")
+	} else {
+		s = arg
+	}
+	sz, err := strconv.ParseInt(s, 10, 32)
+	return int(sz) * mult, err
+}
+
+// parseDuration parses a number of seconds, suffixed with ms, m, or h for milliseconds, minutes or hours.
+func parseDuration(arg string) (time.Duration, error) {
+	var mult = time.Second
+	var s string
+	if strings.HasSuffix(arg, "ms") {
+		mult = time.Millisecond
+		s = strings.TrimSuffix(arg, "ms")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = time.Minute
+		s = strings.TrimSuffix(arg, "m")
+	} else if strings.HasSuffix(arg, "h") {
+		mult = time.Hour
+		s = strings.TrimSuffix(arg, "h")
+	} else {
+		s = arg
+	}
+	t, err := strconv.ParseInt(s, 10, 32)
+	return time.Duration(t) * mult, err
+}
+
+// datagramStats tracks the sequence numbers and one-way latency of datagrams stamped by writer.
+type datagramStats struct {
+	received   int
+	duplicated int
+	reordered  int
+	malformed  int
+	highest    uint64
+	seen       map[uint64]bool
+	latency    time.Duration
+	minLatency time.Duration
+	maxLatency time.Duration
+}
+
+// record accounts for one datagram received at now.
+func (d *datagramStats) record(p []byte, now time.Time) {
+	if len(p) < datagramHeader {
+		d.malformed += 1
+		return
+	}
+	seq := binary.BigEndian.Uint64(p)
+	latency := now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(p[8:]))))
+	d.received += 1
+	if d.seen[seq] {
+		d.duplicated += 1
+		return
+	}
+	if len(d.seen) > 0 && seq < d.highest {
+		d.reordered += 1
+	}
+	if seq > d.highest {
+		d.highest = seq
+	}
+	d.seen[seq] = true
+	d.latency += latency
+	if latency < d.minLatency || len(d.seen) == 1 {
+		d.minLatency = latency
+	}
+	if latency > d.maxLatency {
+		d.maxLatency = latency
+	}
+}
+
+// report prints the datagram counts and latency. Datagrams after the highest sequence number seen cannot be
+// counted as lost.
+func (d *datagramStats) report(out io.Writer) {
+	var lost uint64
+	if len(d.seen) > 0 {
+		lost = d.highest + 1 - uint64(len(d.seen))
+	}
+	fmt.Fprintf(out, "Datagrams: %d received, %d lost, %d duplicated, %d reordered, %d malformed\n", d.received, lost,
+		d.duplicated, d.reordered, d.malformed)
+	if len(d.seen) > 0 {
+		fmt.Fprintf(out, "One-way latency: min %s, average %s, max %s\n", d.minLatency.String(),
+			(d.latency / time.Duration(len(d.seen))).String(), d.maxLatency.String())
+	}
+}
+
+// consumer slows reading down in the patterns of a realistic slow consumer.
+type consumer struct {
+	stallAfter  int
+	stallLength time.Duration
+	delayGrowth time.Duration
+	pauseEvery  time.Duration
+	pauseLength time.Duration
+	bufferLimit int
+	bufferDrain time.Duration
+
+	stalled   bool
+	lastPause time.Time
+	held      []byte
+	pauses    int
+	drains    int
+	stallTime time.Duration
+	pauseTime time.Duration
+	drainTime time.Duration
+}
+
+// active reports whether any slow consumer profile is configured.
+func (c *consumer) active() bool {
+	return c.stallAfter > 0 || c.delayGrowth > 0 || c.pauseEvery > 0 || c.bufferLimit > 0
+}
+
+// pace sleeps as the profiles dictate after reading p, which brought the total read to bytes.
+func (c *consumer) pace(p []byte, bytes int, start time.Time) {
+	if c.stallAfter > 0 && !c.stalled && bytes >= c.stallAfter {
+		c.stalled = true
+		time.Sleep(c.stallLength)
+		c.stallTime += c.stallLength
+	}
+	if c.pauseEvery > 0 {
+		if c.lastPause.IsZero() {
+			c.lastPause = start
+		}
+		if time.Since(c.lastPause) >= c.pauseEvery {
+			time.Sleep(c.pauseLength)
+			c.pauses += 1
+			c.pauseTime += c.pauseLength
+			c.lastPause = time.Now()
+		}
+	}
+	if c.bufferLimit > 0 {
+		c.held = append(c.held, p...)
+		if len(c.held) >= c.bufferLimit {
+			time.Sleep(c.bufferDrain)
+			c.drains += 1
+			c.drainTime += c.bufferDrain
+			c.held = c.held[:0]
+		}
+	}
+}
+
+// report prints how long the profiles held reading back.
+func (c *consumer) report(out io.Writer, units string) {
+	fmt.Fprintf(out, "Slow consumer: stalled %s, %d pauses taking %s, %d buffer drains of %s taking %s\n",
+		c.stallTime.String(), c.pauses, c.pauseTime.String(), c.drains, stats.FormatBytes(float64(c.bufferLimit), units),
+		c.drainTime.String())
+}
+
+// mapping reads a file through a shared memory map, copying each block out of the mapping so its pages are
+// touched in order (seq) or with blocks taken in a random order, each once (rand).
+type mapping struct {
+	file    *os.File
+	data    []byte
+	pattern string
+	block   int
+	off     int
+	perm    []int
+}
+
+func openMapping(f *os.File, pattern string, block int) (*mapping, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	m := &mapping{file: f, pattern: pattern, block: block}
+	if fi.Size() > 0 {
+		if m.data, err = syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED); err != nil {
+			return nil, fmt.Errorf("could not map %s: %v", f.Name(), err)
+		}
+	}
+	if pattern == "rand" {
+		m.perm = rand.New(rand.NewSource(time.Now().UnixNano())).Perm((len(m.data) + block - 1) / block)
+	}
+	return m, nil
+}
+
+// Read copies the next block, or as much of it as fits in p, out of the mapping.
+func (m *mapping) Read(p []byte) (int, error) {
+	start, end := m.off, len(m.data)
+	if m.pattern == "rand" {
+		if len(m.perm) == 0 {
+			return 0, io.EOF
+		}
+		start = m.perm[0] * m.block
+		if start+m.block < end {
+			end = start + m.block
+		}
+		m.perm = m.perm[1:]
+	} else if start >= end {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[start:end])
+	m.off += n
+	return n, nil
+}
+
+func (m *mapping) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is mapped read-only", m.file.Name())
+}
+
+func (m *mapping) Close() error {
+	if m.data != nil {
+		syscall.Munmap(m.data)
+		m.data = nil
+	}
+	return m.file.Close()
+}
+
+// report prints the mapping's size and the page faults taken between the two usage samples.
+func (m *mapping) report(out io.Writer, before, after stats.Usage, units string) {
+	fmt.Fprintf(out, "Mapped %s (%s) in %s order, %d minor and %d major page faults\n", m.file.Name(),
+		stats.FormatBytes(float64(len(m.data)), units), m.pattern, after.Rusage.Minflt-before.Rusage.Minflt,
+		after.Rusage.Majflt-before.Rusage.Majflt)
+}
+
+// follower keeps reading a file past EOF like tail -F. At EOF it waits for more data, starting over from the
+// beginning if the file shrinks (truncation) and switching to the new file if a different one appears at the
+// path (rotation), so each file seen at the path is a generation.
+type follower struct {
+	path        string
+	file        *os.File
+	poll        time.Duration
+	deadline    time.Time
+	generations []*generation
+}
+
+// generation is one file seen at a followed path.
+type generation struct {
+	inode       uint64
+	bytes       int
+	truncations int
+}
+
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+func newFollower(f *os.File, path string, poll time.Duration) (*follower, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &follower{path: path, file: f, poll: poll, generations: []*generation{{inode: inode(fi)}}}, nil
+}
+
+func (f *follower) Read(p []byte) (int, error) {
+	for {
+		gen := f.generations[len(f.generations)-1]
+		n, err := f.file.Read(p)
+		gen.bytes += n
+		if n > 0 || (err != nil && err != io.EOF) {
+			return n, err
+		}
+		if fi, err := os.Stat(f.path); err == nil && inode(fi) != gen.inode {
+			next, err := os.Open(f.path)
+			if err != nil {
+				return 0, err
+			}
+			f.file.Close()
+			f.file = next
+			f.generations = append(f.generations, &generation{inode: inode(fi)})
+			continue
+		}
+		fi, err := f.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset, err := f.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		if fi.Size() < offset {
+			if _, err := f.file.Seek(0, io.SeekStart); err != nil {
+				return 0, err
+			}
+			gen.truncations += 1
+			continue
+		}
+		if !f.deadline.IsZero() && time.Now().After(f.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(f.poll)
+	}
+}
+
+func (f *follower) Write(p []byte) (int, error) {
+	return f.file.Write(p)
+}
+
+// SetReadDeadline makes a read waiting for more data give up at t.
+func (f *follower) SetReadDeadline(t time.Time) error {
+	f.deadline = t
+	return nil
+}
+
+func (f *follower) Close() error {
+	return f.file.Close()
+}
+
+// report prints how much was read from each generation of the file.
+func (f *follower) report(out io.Writer, units string) {
+	for i, gen := range f.generations {
+		fmt.Fprintf(out, "Generation %d of %s (inode %d): read %d bytes (%s), truncated %d times\n", i, f.path,
+			gen.inode, gen.bytes, stats.FormatBytes(float64(gen.bytes), units), gen.truncations)
+	}
 }
 
 func main() {
@@ -48,6 +428,21 @@ func main() {
 	var count = -1
 	var delay, openDelay, exitDelay, startDelay, timeout time.Duration
 	var log io.Writer = os.Stdout
+	var units = "iec"
+	var resourceUsage bool
+	var fail endpoint.Failure
+	var slow consumer
+	var followPoll time.Duration
+	var mapPattern string
+	var waitFor string
+	var waitTimeout time.Duration
+	var accepts = 1
+	var sockOpts endpoint.Options
+	var mkFIFO, rmFIFO bool
+	var pipeQuery bool
+	var pipeSize int
+	var csvFile io.Writer
+	var csvInterval = time.Second
 	var rc int
 
 	var skip = true
@@ -72,22 +467,11 @@ func main() {
 		case "-s":
 			arg += 1
 			skip = true
-			var mult = 1
-			var s string
-			if strings.HasSuffix(os.Args[arg], "k") {
-				mult = 1024
-				s = strings.TrimSuffix(os.Args[arg], "k")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = 1024 * 1024
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else {
-				s = os.Args[arg]
-			}
-			sz, err := strconv.ParseInt(s, 10, 32)
+			sz, err := parseSize(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for size '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for size '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			size = int(sz) * mult
+			size = sz
 		case "-c":
 			arg += 1
 			skip = true
@@ -100,113 +484,58 @@ func main() {
 		case "-d":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			delay = time.Duration(t) * mult
+			delay = t
 		case "-od":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			openDelay = t
+		case "-wf":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "exists" && os.Args[arg] != "nonempty" && os.Args[arg] != "closed" {
+				handleError(fmt.Errorf("invalid argument for wait for '%s'", os.Args[arg]), log, syntaxError)
 			}
-			openDelay = time.Duration(t) * mult
+			waitFor = os.Args[arg]
+		case "-wt":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("invalid argument for wait timeout '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			waitTimeout = t
 		case "-ed":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for exit delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			exitDelay = time.Duration(t) * mult
+			exitDelay = t
 		case "-t":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			timeout = time.Duration(t) * mult
+			timeout = t
 		case "-sd":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			startDelay = time.Duration(t) * mult
+			startDelay = t
 		case "-rc":
 			arg += 1
 			skip = true
@@ -215,6 +544,190 @@ func main() {
 				handleError(fmt.Errorf("Invalid return code '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
 			rc = returnCode
+		case "-fm":
+			arg += 1
+			skip = true
+			switch os.Args[arg] {
+			case "error", "kill", "exit", "close", "hang":
+				fail.Mode = os.Args[arg]
+			default:
+				handleError(fmt.Errorf("invalid argument for fail mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+		case "-fb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for fail bytes '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			fail.AfterBytes = sz
+		case "-fo":
+			arg += 1
+			skip = true
+			n, err := strconv.Atoi(os.Args[arg])
+			if err != nil || n <= 0 {
+				handleError(fmt.Errorf("invalid argument for fail ops '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			fail.AfterOps = n
+		case "-tf":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for tail follow '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			followPoll = t
+		case "-mm":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "seq" && os.Args[arg] != "rand" {
+				handleError(fmt.Errorf("invalid argument for memory map '%s'", os.Args[arg]), log, syntaxError)
+			}
+			mapPattern = os.Args[arg]
+		case "-sa":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for stall after '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.stallAfter = sz
+		case "-sl":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for stall length '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.stallLength = t
+		case "-dg":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for delay growth '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.delayGrowth = t
+		case "-pe":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for pause every '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.pauseEvery = t
+		case "-pl":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for pause length '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.pauseLength = t
+		case "-bm":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for buffer memory '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.bufferLimit = sz
+		case "-bd":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t < 0 {
+				handleError(fmt.Errorf("invalid argument for buffer drain '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			slow.bufferDrain = t
+		case "-n":
+			arg += 1
+			skip = true
+			n, err := strconv.Atoi(os.Args[arg])
+			if err != nil || n < 1 {
+				handleError(fmt.Errorf("invalid argument for connections '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			accepts = n
+		case "-nd":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "on" && os.Args[arg] != "off" {
+				handleError(fmt.Errorf("invalid argument for no delay '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.NoDelay = os.Args[arg]
+		case "-sb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for send buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.SndBuf = sz
+		case "-rb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for receive buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.RcvBuf = sz
+		case "-pm":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "raw" && os.Args[arg] != "cooked" {
+				handleError(fmt.Errorf("invalid argument for pty mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyMode = os.Args[arg]
+		case "-pw":
+			arg += 1
+			skip = true
+			cols, rows, _ := strings.Cut(os.Args[arg], "x")
+			c, err := strconv.Atoi(cols)
+			r, err2 := strconv.Atoi(rows)
+			if err != nil || err2 != nil || c <= 0 || r <= 0 || c > 65535 || r > 65535 {
+				handleError(fmt.Errorf("invalid argument for pty window '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyCols, sockOpts.PtyRows = c, r
+		case "-mf":
+			mkFIFO = true
+		case "-rf":
+			rmFIFO = true
+		case "-pq":
+			pipeQuery = true
+		case "-ps":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for pipe size '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			pipeQuery = true
+			pipeSize = sz
+		case "-csv":
+			arg += 1
+			skip = true
+			f, err := os.Create(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("could not open CSV log: %v", err), log, syntaxError)
+			}
+			csvFile = f
+		case "-ci":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for CSV interval '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			csvInterval = t
+		case "-ru":
+			resourceUsage = true
+		case "-u":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "iec" && os.Args[arg] != "si" {
+				handleError(fmt.Errorf("invalid argument for units '%s'", os.Args[arg]), log, syntaxError)
+			}
+			units = os.Args[arg]
 		case "-h":
 			usage(log)
 		default:
@@ -223,44 +736,187 @@ func main() {
 	}
 
 	buf := make([]byte, size)
-	var input *os.File
+	var input io.ReadWriteCloser
+	var inputName = "stdin"
+	var openTime time.Duration
+	var fdKind string
+	var follow *follower
+	var mapped *mapping
 	var err error
+	var waitTime time.Duration
+	if waitFor != "" && (fileName == "" || endpoint.IsURL(fileName)) {
+		handleError(fmt.Errorf("wait for needs a file path for -f"), log, syntaxError)
+	}
+	if followPoll > 0 && (fileName == "" || endpoint.IsURL(fileName)) {
+		handleError(fmt.Errorf("follow needs a file path for -f"), log, syntaxError)
+	}
+	if mapPattern != "" && (fileName == "" || endpoint.IsURL(fileName) || followPoll > 0) {
+		handleError(fmt.Errorf("memory map needs a file path for -f and cannot follow"), log, syntaxError)
+	}
 	if fileName == "" {
 		input = os.Stdin
 	} else {
+		inputName = fileName
 		time.Sleep(openDelay)
-		input, err = os.Open(fileName)
+		if waitFor != "" {
+			waitStart := time.Now()
+			err = endpoint.WaitForFile(fileName, waitFor, waitTimeout)
+			waitTime = time.Since(waitStart)
+			if err != nil {
+				handleError(err, log, runtimeError)
+			}
+		}
+		if rmFIFO && !endpoint.IsURL(fileName) {
+			endpoint.RemoveFIFOAtExit(fileName)
+		}
+		if mkFIFO && !endpoint.IsURL(fileName) {
+			if err = endpoint.MakeFIFO(fileName); err != nil {
+				handleError(err, log, runtimeError)
+			}
+		}
+		if strings.HasPrefix(fileName, "fd://") {
+			fdKind = endpoint.FdType(fileName)
+		}
+		openStart := time.Now()
+		input, err = endpoint.Open(fileName, os.O_RDONLY, accepts, sockOpts)
+		openTime = time.Since(openStart)
 		if err != nil {
 			handleError(err, log, runtimeError)
 		}
+		if t, ok := input.(*endpoint.Pty); ok && !t.HasChild() {
+			fmt.Fprintf(log, "Opened pty %s\n", t.SlavePath())
+		}
+		if followPoll > 0 {
+			if follow, err = newFollower(input.(*os.File), fileName, followPoll); err != nil {
+				handleError(err, log, runtimeError)
+			}
+			input = follow
+		}
+		if mapPattern != "" {
+			if mapped, err = openMapping(input.(*os.File), mapPattern, size); err != nil {
+				handleError(err, log, runtimeError)
+			}
+			input = mapped
+		}
+	}
+	var inputPipe string
+	if pipeQuery {
+		n, err := endpoint.PipeCapacity(input, inputName, pipeSize)
+		if err != nil && pipeSize != 0 {
+			handleError(err, log, runtimeError)
+		} else if err != nil {
+			inputPipe = err.Error()
+		} else {
+			inputPipe = fmt.Sprintf("Pipe capacity of %s is %d bytes", inputName, n)
+		}
 	}
 	time.Sleep(startDelay)
+	var usageStart stats.Usage
+	if resourceUsage || mapped != nil {
+		usageStart = stats.SampleUsage()
+	}
 	start := time.Now()
-	var runtime time.Duration
-	var bytes, b int
+	if d, ok := input.(interface{ SetReadDeadline(time.Time) error }); ok && timeout != 0 {
+		// Datagram sockets never reach EOF, so a blocked read must not outlast the timeout.
+		d.SetReadDeadline(start.Add(timeout))
+	}
+	var csvLog *stats.IntervalLog
+	if csvFile != nil {
+		csvLog = stats.NewIntervalLog(csvFile, csvInterval, start)
+	}
+	var firstByte, lastByte time.Time
+	var ioTime, delayTime time.Duration
+	var bytes, ops, b int
+	var datagrams *datagramStats
+	if endpoint.IsUDP(fileName) {
+		datagrams = &datagramStats{seen: make(map[uint64]bool)}
+	}
 	for itr := 0; itr != count && err != io.EOF; itr += 1 {
-		runtime = time.Since(start)
-		if runtime >= timeout && timeout != 0 {
+		if time.Since(start) >= timeout && timeout != 0 {
 			break
 		}
-		b, err = input.Read(buf)
+		opStart := time.Now()
+		b, err = input.Read(buf[:fail.Limit(len(buf), bytes)])
+		opEnd := time.Now()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			break
+		}
+		ioTime += opEnd.Sub(opStart)
 		bytes += b
+		ops += 1
+		csvLog.Record(opEnd, b, opEnd.Sub(opStart), err)
+		if b > 0 {
+			if firstByte.IsZero() {
+				firstByte = opEnd
+			}
+			lastByte = opEnd
+			if datagrams != nil {
+				datagrams.record(buf[:b], opEnd)
+			}
+		}
 		if err != nil && err != io.EOF {
-			fmt.Fprintf(log, "Error encountered while reading: %v\n")
+			fmt.Fprintf(log, "Error encountered while reading: %v\n", err)
 			rc = runtimeError
 			break
 		}
+		if fail.Due(bytes, ops) {
+			if err = fail.Inject(input, bytes, ops); err != nil {
+				fmt.Fprintf(log, "Error encountered while reading: %v\n", err)
+				rc = runtimeError
+				break
+			}
+		}
+		slow.pace(buf[:b], bytes, start)
 		time.Sleep(delay)
+		delay += slow.delayGrowth
+		delayTime += time.Since(opEnd)
 	}
-	var bytesRead string
-	if bytes > 1024*1024*10 {
-		bytesRead = fmt.Sprintf("%d megabytes", bytes/1024/1024)
-	} else if bytes > 1024*10 {
-		bytesRead = fmt.Sprintf("%d kilobytes", bytes/1024)
-	} else {
-		bytesRead = fmt.Sprintf("%d bytes", bytes)
+	end := time.Now()
+	csvLog.Flush(end)
+	if w, ok := input.(endpoint.Waiter); ok {
+		w.Wait()
+	}
+	var usageEnd stats.Usage
+	if resourceUsage || mapped != nil {
+		usageEnd = stats.SampleUsage()
+	}
+	wall := end.Sub(start)
+	fmt.Fprintf(log, "Read %d bytes (%s) in %s\n", bytes, stats.FormatBytes(float64(bytes), units), wall.String())
+	fmt.Fprintf(log, "Active I/O %s, delay %s, first byte after %s, last byte after %s\n", ioTime.String(),
+		delayTime.String(), stats.SinceStart(start, firstByte), stats.SinceStart(start, lastByte))
+	if fileName != "" {
+		fmt.Fprintf(log, "Open of %s blocked for %s\n", fileName, openTime.String())
+	}
+	if fdKind != "" {
+		fmt.Fprintf(log, "%s is a %s\n", fileName, fdKind)
+	}
+	if w, ok := input.(endpoint.Waiter); ok {
+		w.Report(log)
+	}
+	if mapped != nil {
+		mapped.report(log, usageStart, usageEnd, units)
+	}
+	if waitFor != "" {
+		fmt.Fprintf(log, "Waited %s for %s (%s)\n", waitTime.String(), fileName, waitFor)
+	}
+	fmt.Fprintf(log, "%s\n", stats.FormatAverage(bytes, ops, units, "read"))
+	fmt.Fprintf(log, "Throughput: %s\n", stats.FormatRate(bytes, ops, wall, units, "read"))
+	fmt.Fprintf(log, "Active throughput: %s\n", stats.FormatRate(bytes, ops, ioTime, units, "read"))
+	if datagrams != nil {
+		datagrams.report(log)
+	}
+	if follow != nil {
+		follow.report(log, units)
+	}
+	if slow.active() {
+		slow.report(log, units)
+	}
+	if inputPipe != "" {
+		fmt.Fprintf(log, "%s\n", inputPipe)
+	}
+	if resourceUsage {
+		stats.ReportUsage(log, usageStart, usageEnd)
 	}
-	fmt.Fprintf(log, "Read %s in %s\n", bytesRead, runtime.String())
 	time.Sleep(exitDelay)
-	os.Exit(rc)
+	exit(rc)
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stamp builds a datagram the way writer does, with seq and the send time in front of the payload.
+func stamp(seq uint64, sent time.Time) []byte {
+	p := make([]byte, datagramHeader+8)
+	binary.BigEndian.PutUint64(p, seq)
+	binary.BigEndian.PutUint64(p[8:], uint64(sent.UnixNano()))
+	return p
+}
+
+func TestDatagramStats(t *testing.T) {
+	tests := []struct {
+		name string
+		seqs []int
+		want string
+	}{
+		{"none", nil, "Datagrams: 0 received, 0 lost, 0 duplicated, 0 reordered, 0 malformed"},
+		{"in order", []int{0, 1, 2, 3}, "Datagrams: 4 received, 0 lost, 0 duplicated, 0 reordered, 0 malformed"},
+		{"gaps", []int{0, 2, 5}, "Datagrams: 3 received, 3 lost, 0 duplicated, 0 reordered, 0 malformed"},
+		{"first lost", []int{1, 2}, "Datagrams: 2 received, 1 lost, 0 duplicated, 0 reordered, 0 malformed"},
+		{"reordered", []int{0, 2, 1, 3}, "Datagrams: 4 received, 0 lost, 0 duplicated, 1 reordered, 0 malformed"},
+		{"late arrivals fill a gap", []int{3, 0, 1, 2},
+			"Datagrams: 4 received, 0 lost, 0 duplicated, 3 reordered, 0 malformed"},
+		{"duplicated", []int{0, 1, 1, 2, 0}, "Datagrams: 5 received, 0 lost, 2 duplicated, 0 reordered, 0 malformed"},
+		{"malformed", []int{0, -1, 1}, "Datagrams: 2 received, 0 lost, 0 duplicated, 0 reordered, 1 malformed"},
+		{"everything", []int{0, 4, 2, 2, -1, 6},
+			"Datagrams: 5 received, 3 lost, 1 duplicated, 1 reordered, 1 malformed"},
+	}
+	sent := time.Unix(1000, 0)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &datagramStats{seen: make(map[uint64]bool)}
+			for _, seq := range tt.seqs {
+				if seq < 0 {
+					d.record(make([]byte, datagramHeader-1), sent)
+					continue
+				}
+				d.record(stamp(uint64(seq), sent), sent.Add(time.Millisecond))
+			}
+			var out bytes.Buffer
+			d.report(&out)
+			if got := strings.Split(out.String(), "\n")[0]; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDatagramStatsLatency(t *testing.T) {
+	d := &datagramStats{seen: make(map[uint64]bool)}
+	sent := time.Unix(1000, 0)
+	d.record(stamp(0, sent), sent.Add(3*time.Millisecond))
+	d.record(stamp(1, sent), sent.Add(1*time.Millisecond))
+	d.record(stamp(2, sent), sent.Add(5*time.Millisecond))
+	// A duplicate does not count towards the latency.
+	d.record(stamp(2, sent), sent.Add(time.Second))
+	var out bytes.Buffer
+	d.report(&out)
+	want := "One-way latency: min 1ms, average 3ms, max 5ms"
+	if got := strings.Split(out.String(), "\n")[1]; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
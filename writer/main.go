@@ -1,22 +1,48 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math/rand"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unsafe"
+
+	"ioTools/internal/endpoint"
+	"ioTools/internal/stats"
 )
 
 const syntaxError = 3
 const runtimeError = 1
 
+// datagramHeader is the size of the sequence number and send time stamped on each UDP datagram.
+const datagramHeader = 16
+
+// exit runs the endpoint cleanups, since os.Exit skips deferred calls, and exits with rc.
+func exit(rc int) {
+	endpoint.RunAtExit()
+	os.Exit(rc)
+}
+
 func usage(out io.Writer) {
 	s := "Writes to a file or stdout in a pattern depending on several parameters.\n" +
 		"By default, writes one 256k block to stdout\n" +
 		"Each block is prefixed with the iteration number (starting at 0) and is filled with zeros\n" +
-		" -f \tFile: file path to write to.\n" +
+		"On udp endpoints each block is one datagram stamped with a 64-bit big-endian sequence number and send time in\n" +
+		"Unix nanoseconds, which reader uses to count lost, duplicated and reordered datagrams and one-way latency.\n" +
+		" -f \tFile: file path to write to,\n" +
+		"    \tor a socket: tcp://host:port, tcp-listen://[host]:port, unix://path, unix-listen://path,\n" +
+		"    \tunixpacket://path, unixpacket-listen://path, udp://host:port or udp-listen://[host]:port,\n" +
+		"    \tor fd://N for a descriptor inherited from the parent process, or exec://command args to run a command\n" +
+		"    \t(without a shell) and write to its stdin.\n" +
+		"    \tpty:// opens a new pseudo-terminal, logging the path of its slave side for another process to use, and\n" +
+		"    \tpty://command args runs a command with the slave side as its terminal.\n" +
+		"    \tUnix socket paths starting with @ are abstract.\n" +
 		" -s \tSize: How many bytes to write each iteration. Suffix with k or m for kilobytes or megabytes.\n" +
 		" -c \tCount: How many writes to try before quitting.\n" +
 		" -d \tDelay: How many seconds to delay between writes. Suffix with ms, m, or h.\n" +
@@ -27,7 +53,43 @@ func usage(out io.Writer) {
 		"	 \treached first. Suffix with ms, m, or h.\n" +
 		" -sd\tStart Delay: How many seconds to delay before the first write. Suffix with ms, m, or h.\n" +
 		" -l \tLog File: Filename to log to.\n" +
-		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0." +
+		" -ss\tSplit Size: Roll the -f file over to a new file every this many bytes. Suffix with k or m. %%d in the\n" +
+		"    \tfile name is replaced by a sequence number and %%t by a timestamp; without either, .N is appended.\n" +
+		" -sc\tSplit Count: Roll the -f file over to a new file every this many writes.\n" +
+		" -st\tSplit Time: Roll the -f file over to a new file at the first write this long after\n" +
+		"    \tthe last roll. Suffix with ms, m, or h.\n" +
+		" -sk\tSplit Keep: Remove the oldest split files so only this many are left.\n" +
+		" -mm\tMemory Map: Write -f through mmap instead of write, with blocks in order (seq) or each once in a\n" +
+		"    \trandom order (rand). The file is preallocated to Size times Count bytes and mapped, and each iteration\n" +
+		"    \tcopies Size bytes into the next block of the mapping. Page faults are reported.\n" +
+		" -ms\tMsync: When -mm flushes the mapping: after each write (each), scheduled after each write (async),\n" +
+		"    \tonce at the end (end) or never (none). Default is end.\n" +
+		" -sm\tShutdown Mode: How to end the output once writing stops. close closes it, shutdown sends SHUT_WR and\n" +
+		"    \treads the response until EOF, reset closes a TCP connection with SO_LINGER 0 so a RST is sent, and idle\n" +
+		"    \tleaves it open until exit after Exit Delay. Default is idle.\n" +
+		" -fm\tFail Mode: Simulate a failing writer once -fb or -fo is reached. error stops with an I/O error,\n" +
+		"    \tkill sends SIGKILL to this process, exit exits at once without a summary or cleanup, close closes the\n" +
+		"    \tendpoint and carries on so later writes fail, and hang stops doing anything without exiting.\n" +
+		" -fb\tFail Bytes: Inject the -fm failure once this many bytes have been written. Suffix with k or m.\n" +
+		" -fo\tFail Ops: Inject the -fm failure once this many writes have been made.\n" +
+		" -n \tConnections: How many connections a listening endpoint accepts. Each block is written to every connection. Default is 1.\n" +
+		" -nd\tNo Delay: Set TCP_NODELAY on or off for TCP connections. Defaults to the Go runtime's setting (on).\n" +
+		" -sb\tSend Buffer: SO_SNDBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -rb\tReceive Buffer: SO_RCVBUF for socket connections. Suffix with k or m for kilobytes or megabytes.\n" +
+		" -pm\tPty Mode: Line discipline of pty:// endpoints, raw or cooked. Default is cooked.\n" +
+		" -pw\tPty Window: Window size of pty:// endpoints as COLSxROWS, such as 80x24.\n" +
+		" -mf\tMake FIFO: Create a named pipe at -f if nothing exists there.\n" +
+		" -rf\tRemove FIFO: Remove the named pipe at -f on exit. Anything other than a FIFO is left in place.\n" +
+		" -pq\tPipe Query: Report the kernel buffer size of stdout or the FIFO at -f in the summary.\n" +
+		" -ps\tPipe Size: Resize the kernel buffer of stdout or the FIFO at -f with F_SETPIPE_SZ. Suffix with k or m\n" +
+		"    \tfor kilobytes or megabytes. Implies -pq.\n" +
+		" -csv\tCSV Log: Write one row per interval (timestamp, bytes, ops, throughput, p99 latency of each\n" +
+		"    \twrite, errors) to this file.\n" +
+		" -ci\tCSV Interval: How many seconds each CSV row covers. Suffix with ms, m, or h. Default is 1.\n" +
+		" -ru\tResource Usage: Include CPU time, context switches, page faults and kernel I/O counters\n" +
+		"    \t(/proc/self/io) in the summary.\n" +
+		" -u \tUnits: Unit prefixes used in the summary, either iec (KiB, MiB, ...) or si (kB, MB, ...). Default is iec.\n" +
+		" -rc\tReturn Code: Return code on successful exit. Will be overridden by any errors. Default is 0.\n" +
 		" -h \tHelp: Prints this text\n" +
 		"Returns 0 on success, 1 if a runtime error is encountered, 3 if bad arguments are passed.\n"
 	fmt.Fprintf(out, s)
@@ -40,7 +102,196 @@ func handleError(err error, out io.Writer, rc int) {
 	} else {
 		fmt.Fprintf(out, "%v\n", err)
 	}
-	os.Exit(rc)
+	exit(rc)
+}
+
+// parseSize parses a number of bytes, suffixed with k or m for kilobytes or megabytes.
+func parseSize(arg string) (int, error) {
+	var mult = 1
+	var s string
+	if strings.HasSuffix(arg, "k") {
+		mult = 1024
+		s = strings.TrimSuffix(arg, "k")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = 1024 * 1024
+		s = strings.TrimSuffix(arg, "m")
+	} else {
+		s = arg
+	}
+	sz, err := strconv.ParseInt(s, 10, 32)
+	return int(sz) * mult, err
+}
+
+// parseDuration parses a number of seconds, suffixed with ms, m, or h for milliseconds, minutes or hours.
+func parseDuration(arg string) (time.Duration, error) {
+	var mult = time.Second
+	var s string
+	if strings.HasSuffix(arg, "ms") {
+		mult = time.Millisecond
+		s = strings.TrimSuffix(arg, "ms")
+	} else if strings.HasSuffix(arg, "m") {
+		mult = time.Minute
+		s = strings.TrimSuffix(arg, "m")
+	} else if strings.HasSuffix(arg, "h") {
+		mult = time.Hour
+		s = strings.TrimSuffix(arg, "h")
+	} else {
+		s = arg
+	}
+	t, err := strconv.ParseInt(s, 10, 32)
+	return time.Duration(t) * mult, err
+}
+
+// shutdownConn ends the connection rw according to mode, returning how many bytes of response were read after a
+// shutdown.
+func shutdownConn(rw io.ReadWriteCloser, mode string) (int, error) {
+	if g, ok := rw.(*endpoint.ConnGroup); ok {
+		var total int
+		for _, c := range g.Conns() {
+			n, err := shutdownConn(c, mode)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, g.Close()
+	}
+	switch mode {
+	case "shutdown":
+		cw, ok := rw.(interface{ CloseWrite() error })
+		if !ok {
+			return 0, fmt.Errorf("shutdown needs a TCP or Unix stream socket")
+		}
+		if err := cw.CloseWrite(); err != nil {
+			return 0, err
+		}
+		n, err := io.Copy(io.Discard, rw)
+		rw.Close()
+		return int(n), err
+	case "reset":
+		tc, ok := rw.(*net.TCPConn)
+		if !ok {
+			return 0, fmt.Errorf("reset needs a TCP socket")
+		}
+		if err := tc.SetLinger(0); err != nil {
+			return 0, err
+		}
+		return 0, tc.Close()
+	default:
+		return 0, rw.Close()
+	}
+}
+
+// mapping writes a file through a shared memory map of count blocks, preallocated so every write lands in
+// memory. Each write fills the next block in order (seq) or the next of the blocks in a random order, each once
+// (rand). The mapping is flushed with msync as sync says: after each write (each), scheduled after each write
+// (async), once when closed (end) or never (none), leaving it to the kernel.
+type mapping struct {
+	file     *os.File
+	data     []byte
+	length   int
+	pattern  string
+	block    int
+	perm     []int
+	off      int
+	high     int
+	sync     string
+	syncs    int
+	syncTime time.Duration
+}
+
+func openMapping(name string, pattern string, block, count int, sync string) (*mapping, error) {
+	length := block * count
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Fallocate(int(f.Fd()), 0, 0, int64(length)); err != nil {
+		// Not every file system can preallocate; a sparse file still maps.
+		if err = f.Truncate(int64(length)); err != nil {
+			return nil, err
+		}
+	}
+	m := &mapping{file: f, length: length, pattern: pattern, block: block, sync: sync}
+	m.data, err = syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("could not map %s: %v", name, err)
+	}
+	if pattern == "rand" {
+		m.perm = rand.New(rand.NewSource(time.Now().UnixNano())).Perm(count)
+	}
+	return m, nil
+}
+
+// msync flushes data[start:end] after widening it to whole pages, as msync needs.
+func (m *mapping) msync(start, end, flags int) error {
+	start -= start % os.Getpagesize()
+	syncStart := time.Now()
+	_, _, e := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m.data[start])), uintptr(end-start),
+		uintptr(flags))
+	m.syncTime += time.Since(syncStart)
+	m.syncs += 1
+	if e != 0 {
+		return fmt.Errorf("msync failed: %v", e)
+	}
+	return nil
+}
+
+// Write copies p into the mapping at the next block, failing with io.ErrShortWrite once the mapping is full.
+func (m *mapping) Write(p []byte) (int, error) {
+	start, end := m.off, m.length
+	if m.pattern == "rand" {
+		if len(m.perm) == 0 {
+			return 0, io.ErrShortWrite
+		}
+		start = m.perm[0] * m.block
+		end = start + m.block
+		m.perm = m.perm[1:]
+	}
+	n := copy(m.data[start:end], p)
+	m.off += n
+	if start+n > m.high {
+		m.high = start + n
+	}
+	var err error
+	if n > 0 && m.sync == "each" {
+		err = m.msync(start, start+n, syscall.MS_SYNC)
+	} else if n > 0 && m.sync == "async" {
+		err = m.msync(start, start+n, syscall.MS_ASYNC)
+	}
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+func (m *mapping) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (m *mapping) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	var err error
+	if m.sync == "end" && m.high > 0 {
+		err = m.msync(0, m.high, syscall.MS_SYNC)
+	}
+	syscall.Munmap(m.data)
+	m.data = nil
+	if cerr := m.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// report prints the mapping's size, the msync calls made and the page faults taken between the two usage
+// samples.
+func (m *mapping) report(out io.Writer, before, after stats.Usage, units string) {
+	fmt.Fprintf(out, "Mapped %s (%s) in %s order, %d minor and %d major page faults\n", m.file.Name(),
+		stats.FormatBytes(float64(m.length), units), m.pattern, after.Rusage.Minflt-before.Rusage.Minflt,
+		after.Rusage.Majflt-before.Rusage.Majflt)
+	fmt.Fprintf(out, "msync (%s) called %d times taking %s\n", m.sync, m.syncs, m.syncTime.String())
 }
 
 func main() {
@@ -49,6 +300,20 @@ func main() {
 	var count = 1
 	var delay, openDelay, exitDelay, startDelay, timeout time.Duration
 	var log = io.Discard
+	var units = "iec"
+	var resourceUsage bool
+	var fail endpoint.Failure
+	var split endpoint.Splitter
+	var mapPattern string
+	var msyncPolicy = "end"
+	var accepts = 1
+	var shutdownMode = "idle"
+	var sockOpts endpoint.Options
+	var mkFIFO, rmFIFO bool
+	var pipeQuery bool
+	var pipeSize int
+	var csvFile io.Writer
+	var csvInterval = time.Second
 	var rc int
 
 	var skip = true
@@ -73,22 +338,11 @@ func main() {
 		case "-s":
 			arg += 1
 			skip = true
-			var mult = 1
-			var s string
-			if strings.HasSuffix(os.Args[arg], "k") {
-				mult = 1024
-				s = strings.TrimSuffix(os.Args[arg], "k")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = 1024 * 1024
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else {
-				s = os.Args[arg]
-			}
-			sz, err := strconv.ParseInt(s, 10, 32)
+			sz, err := parseSize(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for size '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for size '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			size = int(sz) * mult
+			size = sz
 		case "-c":
 			arg += 1
 			skip = true
@@ -101,113 +355,75 @@ func main() {
 		case "-d":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			delay = time.Duration(t) * mult
+			delay = t
 		case "-od":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			openDelay = time.Duration(t) * mult
+			openDelay = t
 		case "-ed":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for open delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for exit delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			exitDelay = time.Duration(t) * mult
+			exitDelay = t
 		case "-t":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for timeout '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			timeout = t
+		case "-ss":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for split size '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			timeout = time.Duration(t) * mult
+			split.Size = sz
+		case "-sc":
+			arg += 1
+			skip = true
+			c, err := strconv.ParseInt(os.Args[arg], 10, 32)
+			if err != nil || c <= 0 {
+				handleError(fmt.Errorf("invalid argument for split count '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Count = int(c)
+		case "-st":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for split time '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Period = t
+		case "-sk":
+			arg += 1
+			skip = true
+			k, err := strconv.ParseInt(os.Args[arg], 10, 32)
+			if err != nil || k <= 0 {
+				handleError(fmt.Errorf("invalid argument for split keep '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			split.Keep = int(k)
 		case "-sd":
 			arg += 1
 			skip = true
-			var mult = time.Second
-			var s string
-			if strings.HasSuffix(os.Args[arg], "ms") {
-				mult = time.Millisecond
-				s = strings.TrimSuffix(os.Args[arg], "ms")
-			} else if strings.HasSuffix(os.Args[arg], "m") {
-				mult = time.Minute
-				s = strings.TrimSuffix(os.Args[arg], "m")
-			} else if strings.HasSuffix(os.Args[arg], "h") {
-				mult = time.Hour
-				s = strings.TrimSuffix(os.Args[arg], "h")
-			} else {
-				s = os.Args[arg]
-			}
-			t, err := strconv.ParseInt(s, 10, 32)
+			t, err := parseDuration(os.Args[arg])
 			if err != nil {
-				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", s, err), log, syntaxError)
+				handleError(fmt.Errorf("invalid argument for start delay '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
-			startDelay = time.Duration(t) * mult
+			startDelay = t
 		case "-rc":
 			arg += 1
 			skip = true
@@ -216,6 +432,144 @@ func main() {
 				handleError(fmt.Errorf("Invalid return code '%s': %v", os.Args[arg], err), log, syntaxError)
 			}
 			rc = returnCode
+		case "-mm":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "seq" && os.Args[arg] != "rand" {
+				handleError(fmt.Errorf("invalid argument for memory map '%s'", os.Args[arg]), log, syntaxError)
+			}
+			mapPattern = os.Args[arg]
+		case "-ms":
+			arg += 1
+			skip = true
+			switch os.Args[arg] {
+			case "none", "async", "each", "end":
+				msyncPolicy = os.Args[arg]
+			default:
+				handleError(fmt.Errorf("invalid argument for msync '%s'", os.Args[arg]), log, syntaxError)
+			}
+		case "-sm":
+			arg += 1
+			skip = true
+			switch os.Args[arg] {
+			case "close", "shutdown", "reset", "idle":
+				shutdownMode = os.Args[arg]
+			default:
+				handleError(fmt.Errorf("invalid argument for shutdown mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+		case "-fm":
+			arg += 1
+			skip = true
+			switch os.Args[arg] {
+			case "error", "kill", "exit", "close", "hang":
+				fail.Mode = os.Args[arg]
+			default:
+				handleError(fmt.Errorf("invalid argument for fail mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+		case "-fb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for fail bytes '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			fail.AfterBytes = sz
+		case "-fo":
+			arg += 1
+			skip = true
+			n, err := strconv.Atoi(os.Args[arg])
+			if err != nil || n <= 0 {
+				handleError(fmt.Errorf("invalid argument for fail ops '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			fail.AfterOps = n
+		case "-n":
+			arg += 1
+			skip = true
+			n, err := strconv.Atoi(os.Args[arg])
+			if err != nil || n < 1 {
+				handleError(fmt.Errorf("invalid argument for connections '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			accepts = n
+		case "-nd":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "on" && os.Args[arg] != "off" {
+				handleError(fmt.Errorf("invalid argument for no delay '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.NoDelay = os.Args[arg]
+		case "-sb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for send buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.SndBuf = sz
+		case "-rb":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for receive buffer '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			sockOpts.RcvBuf = sz
+		case "-pm":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "raw" && os.Args[arg] != "cooked" {
+				handleError(fmt.Errorf("invalid argument for pty mode '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyMode = os.Args[arg]
+		case "-pw":
+			arg += 1
+			skip = true
+			cols, rows, _ := strings.Cut(os.Args[arg], "x")
+			c, err := strconv.Atoi(cols)
+			r, err2 := strconv.Atoi(rows)
+			if err != nil || err2 != nil || c <= 0 || r <= 0 || c > 65535 || r > 65535 {
+				handleError(fmt.Errorf("invalid argument for pty window '%s'", os.Args[arg]), log, syntaxError)
+			}
+			sockOpts.PtyCols, sockOpts.PtyRows = c, r
+		case "-mf":
+			mkFIFO = true
+		case "-rf":
+			rmFIFO = true
+		case "-pq":
+			pipeQuery = true
+		case "-ps":
+			arg += 1
+			skip = true
+			sz, err := parseSize(os.Args[arg])
+			if err != nil || sz <= 0 {
+				handleError(fmt.Errorf("invalid argument for pipe size '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			pipeQuery = true
+			pipeSize = sz
+		case "-csv":
+			arg += 1
+			skip = true
+			f, err := os.Create(os.Args[arg])
+			if err != nil {
+				handleError(fmt.Errorf("could not open CSV log: %v", err), log, syntaxError)
+			}
+			csvFile = f
+		case "-ci":
+			arg += 1
+			skip = true
+			t, err := parseDuration(os.Args[arg])
+			if err != nil || t <= 0 {
+				handleError(fmt.Errorf("invalid argument for CSV interval '%s': %v", os.Args[arg], err), log, syntaxError)
+			}
+			csvInterval = t
+		case "-ru":
+			resourceUsage = true
+		case "-u":
+			arg += 1
+			skip = true
+			if os.Args[arg] != "iec" && os.Args[arg] != "si" {
+				handleError(fmt.Errorf("invalid argument for units '%s'", os.Args[arg]), log, syntaxError)
+			}
+			units = os.Args[arg]
 		case "-h":
 			usage(log)
 		default:
@@ -223,45 +577,177 @@ func main() {
 		}
 	}
 
+	datagrams := endpoint.IsUDP(fileName)
+	if datagrams && size < datagramHeader {
+		handleError(fmt.Errorf("size must be at least %d bytes on udp endpoints", datagramHeader), log, syntaxError)
+	}
 	buf := make([]byte, size)
-	var bytes int
-	var output *os.File
+	var bytes, ops int
+	var output io.ReadWriteCloser
+	var outputName = "stdout"
+	var openTime time.Duration
+	var fdKind string
+	var splitOut *endpoint.Splitter
+	var mapped *mapping
 	var err error
+	if mapPattern != "" && (fileName == "" || endpoint.IsURL(fileName) || split.Enabled() || count <= 0) {
+		handleError(fmt.Errorf("memory map needs a file path for -f and a Count, and cannot split"), log, syntaxError)
+	}
+	if split.Enabled() && (fileName == "" || endpoint.IsURL(fileName)) {
+		handleError(fmt.Errorf("splitting output needs a file path for -f"), log, syntaxError)
+	}
 	if fileName == "" {
 		output = os.Stdout
 	} else {
+		outputName = fileName
 		time.Sleep(openDelay)
-		output, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0755)
+		if rmFIFO && !endpoint.IsURL(fileName) {
+			endpoint.RemoveFIFOAtExit(fileName)
+		}
+		if mkFIFO && !endpoint.IsURL(fileName) {
+			if err = endpoint.MakeFIFO(fileName); err != nil {
+				handleError(err, log, runtimeError)
+			}
+		}
+		if strings.HasPrefix(fileName, "fd://") {
+			fdKind = endpoint.FdType(fileName)
+		}
+		openStart := time.Now()
+		if split.Enabled() {
+			splitOut, err = split.Open(fileName)
+			output = splitOut
+		} else if mapPattern != "" {
+			mapped, err = openMapping(fileName, mapPattern, size, count, msyncPolicy)
+			output = mapped
+		} else {
+			output, err = endpoint.Open(fileName, os.O_WRONLY|os.O_CREATE, accepts, sockOpts)
+		}
+		openTime = time.Since(openStart)
 		if err != nil {
 			handleError(err, log, runtimeError)
 		}
+		if t, ok := output.(*endpoint.Pty); ok && !t.HasChild() {
+			fmt.Fprintf(log, "Opened pty %s\n", t.SlavePath())
+		}
+	}
+	var outputPipe string
+	if pipeQuery {
+		n, err := endpoint.PipeCapacity(output, outputName, pipeSize)
+		if err != nil && pipeSize != 0 {
+			handleError(err, log, runtimeError)
+		} else if err != nil {
+			outputPipe = err.Error()
+		} else {
+			outputPipe = fmt.Sprintf("Pipe capacity of %s is %d bytes", outputName, n)
+		}
 	}
 	time.Sleep(startDelay)
+	var usageStart stats.Usage
+	if resourceUsage || mapped != nil {
+		usageStart = stats.SampleUsage()
+	}
 	start := time.Now()
-	var runtime time.Duration
+	var csvLog *stats.IntervalLog
+	if csvFile != nil {
+		csvLog = stats.NewIntervalLog(csvFile, csvInterval, start)
+	}
+	var firstByte, lastByte time.Time
+	var ioTime, delayTime time.Duration
 	for itr := 0; itr != count; itr += 1 {
-		runtime = time.Since(start)
-		if runtime >= timeout && timeout != 0 {
+		if time.Since(start) >= timeout && timeout != 0 {
 			break
 		}
-		b, err := output.Write(buf)
+		opStart := time.Now()
+		if datagrams {
+			binary.BigEndian.PutUint64(buf, uint64(itr))
+			binary.BigEndian.PutUint64(buf[8:], uint64(opStart.UnixNano()))
+		}
+		b, err := output.Write(buf[:fail.Limit(len(buf), bytes)])
+		opEnd := time.Now()
+		ioTime += opEnd.Sub(opStart)
 		bytes += b
+		ops += 1
+		csvLog.Record(opEnd, b, opEnd.Sub(opStart), err)
+		if b > 0 {
+			if firstByte.IsZero() {
+				firstByte = opEnd
+			}
+			lastByte = opEnd
+		}
 		if err != nil {
-			fmt.Fprintf(log, "Error encountered while writing: %v\n")
+			fmt.Fprintf(log, "Error encountered while writing: %v\n", err)
 			rc = runtimeError
 			break
 		}
+		if fail.Due(bytes, ops) {
+			if err = fail.Inject(output, bytes, ops); err != nil {
+				fmt.Fprintf(log, "Error encountered while writing: %v\n", err)
+				rc = runtimeError
+				break
+			}
+		}
 		time.Sleep(delay)
+		delayTime += time.Since(opEnd)
 	}
-	var bytesWritten string
-	if bytes > 1024*1024*10 {
-		bytesWritten = fmt.Sprintf("%d megabytes", bytes/1024/1024)
-	} else if bytes > 1024*10 {
-		bytesWritten = fmt.Sprintf("%d kilobytes", bytes/1024)
-	} else {
-		bytesWritten = fmt.Sprintf("%d bytes", bytes)
+	if mapped != nil {
+		if err := mapped.Close(); err != nil {
+			fmt.Fprintf(log, "Error encountered while unmapping: %v\n", err)
+			rc = runtimeError
+		}
+	}
+	end := time.Now()
+	csvLog.Flush(end)
+	var usageEnd stats.Usage
+	if resourceUsage || mapped != nil {
+		usageEnd = stats.SampleUsage()
+	}
+	var response int
+	var shutdownTime time.Duration
+	if shutdownMode != "idle" {
+		shutdownStart := time.Now()
+		response, err = shutdownConn(output, shutdownMode)
+		shutdownTime = time.Since(shutdownStart)
+		if err != nil {
+			fmt.Fprintf(log, "Error encountered during %s: %v\n", shutdownMode, err)
+			rc = runtimeError
+		}
+	}
+	if w, ok := output.(endpoint.Waiter); ok {
+		w.Wait()
+	}
+	wall := end.Sub(start)
+	fmt.Fprintf(log, "Wrote %d bytes (%s) in %s\n", bytes, stats.FormatBytes(float64(bytes), units), wall.String())
+	fmt.Fprintf(log, "Active I/O %s, delay %s, first byte after %s, last byte after %s\n", ioTime.String(),
+		delayTime.String(), stats.SinceStart(start, firstByte), stats.SinceStart(start, lastByte))
+	if fileName != "" {
+		fmt.Fprintf(log, "Open of %s blocked for %s\n", fileName, openTime.String())
+	}
+	if fdKind != "" {
+		fmt.Fprintf(log, "%s is a %s\n", fileName, fdKind)
+	}
+	if w, ok := output.(endpoint.Waiter); ok {
+		w.Report(log)
+	}
+	if mapped != nil {
+		mapped.report(log, usageStart, usageEnd, units)
+	}
+	if splitOut != nil {
+		splitOut.Report(log)
+	}
+	if shutdownMode == "shutdown" {
+		fmt.Fprintf(log, "Shutdown took %s, reading %d bytes of response\n", shutdownTime.String(), response)
+	} else if shutdownMode != "idle" {
+		fmt.Fprintf(log, "Shutdown by %s took %s\n", shutdownMode, shutdownTime.String())
+	}
+	fmt.Fprintf(log, "%s\n", stats.FormatAverage(bytes, ops, units, "write"))
+	fmt.Fprintf(log, "Throughput: %s\n", stats.FormatRate(bytes, ops, wall, units, "write"))
+	fmt.Fprintf(log, "Active throughput: %s\n", stats.FormatRate(bytes, ops, ioTime, units, "write"))
+	if outputPipe != "" {
+		fmt.Fprintf(log, "%s\n", outputPipe)
+	}
+	if resourceUsage {
+		stats.ReportUsage(log, usageStart, usageEnd)
 	}
-	fmt.Fprintf(log, "Wrote %s in %s\n", bytesWritten, runtime.String())
 	time.Sleep(exitDelay)
-	os.Exit(rc)
+	exit(rc)
 }